@@ -4,54 +4,158 @@ Package api provides the REST api service
 package api
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
 
+/*
+NoCache is the default cache policy. Responses using it must be revalidated
+before they are reused.
+*/
+const NoCache = "private, no-cache, must-revalidate, max-age=0, proxy-revalidate, s-maxage=0"
+
+/*
+contextKey is the type of the request context keys set by the API
+*/
+type contextKey int
+
+const (
+	cachePolicyKey contextKey = iota
+	logURIKey
+)
+
+/*
+secretMask replaces the values of secret query parameters in the logs
+*/
+const secretMask = "********"
+
 /*
 API contains HTTP and SQL helper functions and manages pointers to those resources
 */
 type API struct {
-	router *mux.Router
+	router  *mux.Router
+	secrets map[string]bool
 }
 
 /*
 New initializes and returns a pointer to an API struct
 */
 func New() *API {
-	return &API{router: mux.NewRouter()}
+	return &API{router: mux.NewRouter(), secrets: make(map[string]bool)}
+}
+
+/*
+SecretParams sets the names of the query parameters whose values are masked
+when request URIs are logged
+*/
+func (api *API) SecretParams(names ...string) {
+	for _, name := range names {
+		api.secrets[name] = true
+	}
 }
 
 /*
-Run starts the HTTP listener process
+Run starts the HTTP listener process on addr, e.g. ":80"
 */
-func (api *API) Run(port int) {
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), api.router))
+func (api *API) Run(addr string) {
+	log.Fatal(http.ListenAndServe(addr, api.router))
 }
 
 /*
 Handle is a wrapper to add logging to gorilla/mux managed routes
-This should be used for adding routes to the API service.
+This should be used for adding routes to the API service. Successful
+responses use the NoCache policy.
 */
 func (api *API) Handle(method, path string, handler func(http.ResponseWriter, *http.Request)) (r *mux.Route) {
+	return api.HandleWithCachePolicy(method, path, NoCache, handler)
+}
+
+/*
+HandleWithCachePolicy adds a route whose successful responses are sent with
+the given 'Cache-Control' policy. A handler may still override the policy for
+a single response by setting the 'Cache-Control' header.
+*/
+func (api *API) HandleWithCachePolicy(
+	method,
+	path,
+	policy string,
+	handler func(http.ResponseWriter, *http.Request),
+) (r *mux.Route) {
 	wrapper := func(response http.ResponseWriter, request *http.Request) {
-		log.Infof("%s: %s", request.Method, request.RequestURI)
+		ctx := context.WithValue(request.Context(), cachePolicyKey, policy)
+		request = request.WithContext(context.WithValue(ctx, logURIKey, api.scrubURI(request)))
+		log.Infof("%s: %s", request.Method, logURI(request))
 		handler(response, request)
 	}
-	return api.router.HandleFunc(path, wrapper)
+	return api.router.HandleFunc(path, wrapper).Methods(method)
+}
+
+/*
+scrubURI returns the request URI with the values of the secret query
+parameters masked
+*/
+func (api *API) scrubURI(request *http.Request) string {
+	query := request.URL.Query()
+	scrubbed := false
+	for name, values := range query {
+		if api.secrets[name] {
+			for a := range values {
+				values[a] = secretMask
+			}
+			scrubbed = true
+		}
+	}
+	if !scrubbed {
+		return request.RequestURI
+	}
+	uri := url.URL{Path: request.URL.Path, RawQuery: query.Encode()}
+	return uri.RequestURI()
+}
+
+/*
+logURI returns the request URI to write to the logs, with the values of secret
+query parameters masked
+*/
+func logURI(request *http.Request) string {
+	if uri, ok := request.Context().Value(logURIKey).(string); ok {
+		return uri
+	}
+	return request.RequestURI
+}
+
+/*
+ETag returns a strong entity tag for a response body. Identical bodies always
+produce the same tag.
+*/
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf(`"%x"`, sum[:16])
+}
+
+/*
+Vars returns the route variables for the current request
+*/
+func Vars(request *http.Request) map[string]string {
+	return mux.Vars(request)
 }
 
 /*
 NotFoundHandler is a wrapper to add a route not found handler to the mux router
 */
 func (api *API) NotFoundHandler(handler func(http.ResponseWriter, *http.Request)) {
-	api.router.NotFoundHandler = http.HandlerFunc(handler)
+	api.router.NotFoundHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		request = request.WithContext(context.WithValue(request.Context(), logURIKey, api.scrubURI(request)))
+		handler(response, request)
+	})
 }
 
 /*
@@ -65,9 +169,9 @@ func (api *API) RespondWithErrorBody(
 	payload interface{},
 	headers map[string]string) {
 
-	log.Debugf("%s: %s - Sending error response body", request.Method, request.RequestURI)
+	log.Debugf("%s: %s - Sending error response body", request.Method, logURI(request))
 	if 300 > code {
-		log.Errorf("%s: %s - '%d' is not a valid error response code!", request.Method, request.RequestURI, code)
+		log.Errorf("%s: %s - '%d' is not a valid error response code!", request.Method, logURI(request), code)
 	}
 	api.RespondWithJSONBody(request, response, code, payload, headers)
 }
@@ -82,17 +186,14 @@ func (api *API) RespondWithJSONBody(
 	payload interface{},
 	headers map[string]string) {
 
-	log.Debugf("%s: %s - Sending JSON encoded response body", request.Method, request.RequestURI)
+	log.Debugf("%s: %s - Sending JSON encoded response body", request.Method, logURI(request))
 	response.Header().Set("Content-Type", "application/json")
 	body, err := json.Marshal(payload)
 	if nil != err {
-		log.Errorf("%s: %s - %s", request.Method, request.RequestURI, err)
+		log.Errorf("%s: %s - %s", request.Method, logURI(request), err)
 		code = 500
 		body = []byte(`["An unknown error occurred"]`)
 	}
-	if 300 >= code {
-		addCacheHeaders(response, code)
-	}
 	sendResponse(request, response, code, string(body), headers)
 }
 
@@ -106,7 +207,7 @@ func (api *API) RespondWithEncodedBody(
 	body string,
 	headers map[string]string) {
 
-	log.Debugf("%s: %s - Sending base64 encoded response body", request.Method, request.RequestURI)
+	log.Debugf("%s: %s - Sending base64 encoded response body", request.Method, logURI(request))
 	content := base64.StdEncoding.EncodeToString([]byte(body))
 	sendResponse(request, response, code, string(content), headers)
 }
@@ -121,7 +222,7 @@ func (api *API) RespondWithRawBody(
 	body string,
 	headers map[string]string) {
 
-	log.Debugf("%s: %s - Sending raw response body", request.Method, request.RequestURI)
+	log.Debugf("%s: %s - Sending raw response body", request.Method, logURI(request))
 	sendResponse(request, response, code, body, headers)
 }
 
@@ -134,20 +235,32 @@ func sendResponse(
 ) {
 
 	if 300 > code {
-		addCacheHeaders(response, code)
+		addCacheHeaders(request, response, headers)
 	}
 
-	log.Debugf("%s: %s - Setting 'Access-Control-Allow-Origin' to '*'", request.Method, request.RequestURI)
+	log.Debugf("%s: %s - Setting 'Access-Control-Allow-Origin' to '*'", request.Method, logURI(request))
 	response.Header().Set("Access-Control-Allow-Origin", "*")
 	for k, v := range headers {
 		response.Header().Set(k, v)
 	}
 
+	if 200 == code && notModified(request, response.Header().Get("ETag")) {
+		log.Debugf("%s: %s - Entity tag matches 'If-None-Match'", request.Method, logURI(request))
+		code = http.StatusNotModified
+		body = ""
+		response.Header().Del("Content-Type")
+		response.Header().Del("Content-Disposition")
+	}
+
 	if responseHeaders, err := json.Marshal(response.Header()); nil == err {
-		log.Debugf("%s: %s - Response headers: %s", request.Method, request.RequestURI, responseHeaders)
+		log.Debugf("%s: %s - Response headers: %s", request.Method, logURI(request), responseHeaders)
 	}
 
-	log.Infof("%s: %s - %d %s", request.Method, request.RequestURI, code, http.StatusText(code))
+	log.Infof("%s: %s - %d %s", request.Method, logURI(request), code, http.StatusText(code))
+	response.WriteHeader(code)
+	if "" == body {
+		return
+	}
 	if _, err := response.Write([]byte(body)); nil != err {
 		log.Error(err)
 		if strings.Contains(err.Error(), "Content-Length") {
@@ -158,13 +271,45 @@ func sendResponse(
 
 /*
 addCacheHeaders adds the cache-policy headers to an HTTP response
+
+The policy is the one the route was registered with, unless the handler set
+its own 'Cache-Control' header. Responses that may not be cached are also
+marked with the legacy HTTP/1.0 headers.
 */
-func addCacheHeaders(response http.ResponseWriter, code int) {
-	log.Debugf("Adding cache control headers")
-	response.Header().Set("Cache-Control", "private, no-cache, must-revalidate, max-age=0, proxy-revalidate, s-maxage=0")
-	response.Header().Set("Pragma", "no-cache")
-	response.Header().Set("Expires", "0")
-	if code < 300 || code == 304 {
+func addCacheHeaders(request *http.Request, response http.ResponseWriter, headers map[string]string) {
+	policy, ok := headers["Cache-Control"]
+	if !ok {
+		policy, ok = request.Context().Value(cachePolicyKey).(string)
+	}
+	if !ok || "" == policy {
+		policy = NoCache
+	}
+	log.Debugf("Using the cache policy '%s'", policy)
+	response.Header().Set("Cache-Control", policy)
+	if NoCache == policy {
+		response.Header().Set("Pragma", "no-cache")
+		response.Header().Set("Expires", "0")
 		response.Header().Set("Vary", "*")
 	}
 }
+
+/*
+notModified returns true if the request's 'If-None-Match' header matches the
+entity tag of the response
+*/
+func notModified(request *http.Request, etag string) bool {
+	if "" == etag || ("GET" != request.Method && "HEAD" != request.Method) {
+		return false
+	}
+	match := request.Header.Get("If-None-Match")
+	if "" == match {
+		return false
+	}
+	for _, tag := range strings.Split(match, ",") {
+		tag = strings.TrimSpace(tag)
+		if "*" == tag || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
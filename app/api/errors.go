@@ -0,0 +1,120 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Error codes. Clients may rely on them, the messages are for people and may
+change.
+*/
+const (
+	// CodeInvalidParam is a missing, malformed or conflicting parameter
+	CodeInvalidParam = "INVALID_PARAM"
+	// CodeInvalidBody is a request body that can't be read or decoded
+	CodeInvalidBody = "INVALID_BODY"
+	// CodeTooLarge is a request body or a result that exceeds a size limit
+	CodeTooLarge = "TOO_LARGE"
+	// CodeNotFound is an unknown route or resource
+	CodeNotFound = "NOT_FOUND"
+	// CodeNotReady is a resource that isn't available yet
+	CodeNotReady = "NOT_READY"
+	// CodeScriptError is an exception thrown by a script from the request
+	CodeScriptError = "SCRIPT_ERROR"
+	// CodeRenderFailed is a page that couldn't be rendered
+	CodeRenderFailed = "RENDER_FAILED"
+	// CodeUnavailable is a service that is temporarily unable to respond
+	CodeUnavailable = "UNAVAILABLE"
+	// CodeTimeout is a request that did not complete in time
+	CodeTimeout = "TIMEOUT"
+	// CodeInternal is an unexpected server error
+	CodeInternal = "INTERNAL"
+)
+
+/*
+Error is an API error. It is sent as the 'error' property of the response body
+with the Status response code.
+*/
+type Error struct {
+	Status  int               `json:"-"`
+	Code    string            `json:"code"`
+	Param   string            `json:"param,omitempty"`
+	Message string            `json:"message"`
+	Headers map[string]string `json:"-"`
+}
+
+/*
+Error implements error
+*/
+func (err *Error) Error() string {
+	return err.Message
+}
+
+/*
+NewError returns a pointer to an Error
+*/
+func NewError(status int, code, format string, args ...interface{}) *Error {
+	return &Error{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+/*
+InvalidParam returns a pointer to a 400 Error for the request parameter param
+*/
+func InvalidParam(param, format string, args ...interface{}) *Error {
+	err := NewError(http.StatusBadRequest, CodeInvalidParam, format, args...)
+	err.Param = param
+	return err
+}
+
+/*
+UnprocessableParam returns a pointer to a 422 Error for the request parameter
+param, which is valid but can't be applied to the page
+*/
+func UnprocessableParam(param, format string, args ...interface{}) *Error {
+	err := NewError(http.StatusUnprocessableEntity, CodeInvalidParam, format, args...)
+	err.Param = param
+	return err
+}
+
+/*
+ToError returns err as an *Error. Errors of other types are internal errors.
+*/
+func ToError(err error) *Error {
+	if apiErr, ok := err.(*Error); ok {
+		return apiErr
+	}
+	return NewError(http.StatusInternalServerError, CodeInternal, "%s", err)
+}
+
+/*
+RespondWithError sends err as a JSON error response
+*/
+func (api *API) RespondWithError(
+	request *http.Request,
+	response http.ResponseWriter,
+	err error,
+) {
+	apiErr := ToError(err)
+	if apiErr.Status >= 500 {
+		log.Errorf("%s: %s - %s", request.Method, logURI(request), apiErr.Message)
+	}
+
+	headers := make(map[string]string)
+	for k, v := range apiErr.Headers {
+		headers[k] = v
+	}
+	api.RespondWithErrorBody(
+		request,
+		response,
+		apiErr.Status,
+		map[string]*Error{"error": apiErr},
+		headers,
+	)
+}
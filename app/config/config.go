@@ -0,0 +1,377 @@
+/*
+Package config defines the settings of the HTML conversion service
+
+Settings are read from an optional YAML or JSON file and then from environment
+variables, which take precedence. Settings that are not defined anywhere keep
+their defaults.
+*/
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+/*
+Config contains the settings of the HTML conversion service
+*/
+type Config struct {
+	// Listen is the address the API server listens on. Env LISTEN.
+	// Default ":80"
+	Listen string `json:"listen" yaml:"listen"`
+
+	Chrome  Chrome  `json:"chrome" yaml:"chrome"`
+	Pool    Pool    `json:"pool" yaml:"pool"`
+	Render  Render  `json:"render" yaml:"render"`
+	Cache   Cache   `json:"cache" yaml:"cache"`
+	Jobs    Jobs    `json:"jobs" yaml:"jobs"`
+	Webhook Webhook `json:"webhook" yaml:"webhook"`
+	Storage Storage `json:"storage" yaml:"storage"`
+}
+
+/*
+Chrome contains the browser settings
+*/
+type Chrome struct {
+	// Binary is the path to the Chrome executable. Env CHROME_BINARY.
+	// Default is the go-chrome default
+	Binary string `json:"binary" yaml:"binary"`
+
+	// Port is the DevTools remote debugging port. Env CHROME_PORT.
+	// Default 9222
+	Port int `json:"port" yaml:"port"`
+
+	// Flags are additional Chrome command line flags, e.g.
+	// "--disable-dev-shm-usage" or "--lang=en-US". Env CHROME_FLAGS, space
+	// separated
+	Flags []string `json:"flags" yaml:"flags"`
+
+	// Proxy is the proxy server all page requests are sent through, e.g.
+	// "http://proxy:3128". Env PROXY_SERVER
+	Proxy string `json:"proxy" yaml:"proxy"`
+
+	// UserAgent overrides the browser user-agent string. Env USER_AGENT
+	UserAgent string `json:"user_agent" yaml:"user_agent"`
+
+	// HealthCheckInterval is the number of seconds between browser health
+	// checks. Env HEALTH_CHECK_INTERVAL. Default 5
+	HealthCheckInterval int `json:"health_check_interval" yaml:"health_check_interval"`
+}
+
+/*
+Pool contains the tab pool settings
+*/
+type Pool struct {
+	// Size is the number of concurrent renders. Env POOL_SIZE. Default 4
+	Size int `json:"size" yaml:"size"`
+
+	// Queue is the number of renders that may wait for a tab. Env
+	// POOL_QUEUE. Default 16
+	Queue int `json:"queue" yaml:"queue"`
+}
+
+/*
+Render contains the default timeout and the size limits of render requests
+*/
+type Render struct {
+	// Timeout is the number of seconds to wait for a page when the 'timeout'
+	// parameter is not specified. Env RENDER_TIMEOUT. Default 30
+	Timeout int `json:"timeout" yaml:"timeout"`
+
+	// MaxPageHeight is the tallest full page capture, in pixels. Taller
+	// pages are truncated. Env MAX_PAGE_HEIGHT. Default 16384
+	MaxPageHeight int `json:"max_page_height" yaml:"max_page_height"`
+
+	// MaxPageWidth is the widest element capture, in pixels. Wider
+	// elements are truncated. Env MAX_PAGE_WIDTH. Default 16384
+	MaxPageWidth int `json:"max_page_width" yaml:"max_page_width"`
+
+	// MaxBodySize is the largest request body, in bytes. Env
+	// MAX_BODY_SIZE. Default 10485760
+	MaxBodySize int `json:"max_body_size" yaml:"max_body_size"`
+
+	// MaxBatchSize is the largest number of URLs rendered by one request.
+	// Env MAX_BATCH_SIZE. Default 50
+	MaxBatchSize int `json:"max_batch_size" yaml:"max_batch_size"`
+}
+
+/*
+Cache contains the render cache settings
+*/
+type Cache struct {
+	// Size is the render cache size, in MB. Env CACHE_SIZE. Default 64
+	Size int `json:"size" yaml:"size"`
+
+	// TTL is the number of seconds results are cached. Env CACHE_TTL.
+	// Default 60
+	TTL int `json:"ttl" yaml:"ttl"`
+}
+
+/*
+Jobs contains the asynchronous job settings
+*/
+type Jobs struct {
+	// TTL is the number of seconds finished jobs are kept. Env JOB_TTL.
+	// Default 3600
+	TTL int `json:"ttl" yaml:"ttl"`
+
+	// MaxQueued is the largest number of unfinished jobs. New jobs are
+	// rejected beyond that. Env MAX_QUEUED_JOBS. Default 100
+	MaxQueued int `json:"max_queued" yaml:"max_queued"`
+}
+
+/*
+Webhook contains the job callback settings
+*/
+type Webhook struct {
+	// Secret is the key callbacks are signed with. Callbacks are disabled
+	// without it. Env WEBHOOK_SECRET
+	Secret string `json:"secret" yaml:"secret"`
+
+	// Attempts is the number of delivery attempts per callback. Env
+	// WEBHOOK_ATTEMPTS. Default 5
+	Attempts int `json:"attempts" yaml:"attempts"`
+}
+
+/*
+Storage contains the storage backend settings
+*/
+type Storage struct {
+	// Backend is either "local" or "s3". Storage is disabled when empty.
+	// Env STORAGE
+	Backend string `json:"backend" yaml:"backend"`
+
+	// Path is the local storage directory. Env STORAGE_PATH. Default
+	// "/var/lib/htmltox"
+	Path string `json:"path" yaml:"path"`
+
+	// URLTTL is the number of seconds download URLs of stored results are
+	// valid, at most 604800 for S3. Env STORAGE_URL_TTL. Default 3600
+	URLTTL int `json:"url_ttl" yaml:"url_ttl"`
+
+	S3 S3 `json:"s3" yaml:"s3"`
+}
+
+/*
+S3 contains the S3-compatible storage settings
+*/
+type S3 struct {
+	Endpoint  string `json:"endpoint" yaml:"endpoint"`     // Env S3_ENDPOINT
+	Region    string `json:"region" yaml:"region"`         // Env S3_REGION
+	Bucket    string `json:"bucket" yaml:"bucket"`         // Env S3_BUCKET
+	AccessKey string `json:"access_key" yaml:"access_key"` // Env S3_ACCESS_KEY
+	SecretKey string `json:"secret_key" yaml:"secret_key"` // Env S3_SECRET_KEY
+}
+
+/*
+Default returns a pointer to a Config containing the default settings
+*/
+func Default() *Config {
+	return &Config{
+		Listen: ":80",
+		Chrome: Chrome{
+			Port:                9222,
+			HealthCheckInterval: 5,
+		},
+		Pool: Pool{
+			Size:  4,
+			Queue: 16,
+		},
+		Render: Render{
+			Timeout:       30,
+			MaxPageHeight: 16384,
+			MaxPageWidth:  16384,
+			MaxBodySize:   10 << 20,
+			MaxBatchSize:  50,
+		},
+		Cache: Cache{
+			Size: 64,
+			TTL:  60,
+		},
+		Jobs: Jobs{
+			TTL:       3600,
+			MaxQueued: 100,
+		},
+		Webhook: Webhook{
+			Attempts: 5,
+		},
+		Storage: Storage{
+			Path:   "/var/lib/htmltox",
+			URLTTL: 3600,
+		},
+	}
+}
+
+/*
+Load returns the validated settings. path is an optional YAML or JSON file,
+environment variables override the settings it contains.
+*/
+func Load(path string) (*Config, error) {
+	config := Default()
+	if "" != path {
+		if err := config.read(path); nil != err {
+			return nil, err
+		}
+	}
+	if err := config.env(); nil != err {
+		return nil, err
+	}
+	if err := config.Validate(); nil != err {
+		return nil, err
+	}
+	return config, nil
+}
+
+/*
+read reads the settings from a YAML or JSON file. Files with a '.json'
+extension are decoded as JSON, all others as YAML.
+*/
+func (config *Config) read(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return fmt.Errorf("Failed to read config file: %s", err)
+	}
+	if ".json" == strings.ToLower(filepath.Ext(path)) {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	} else {
+		err = yaml.UnmarshalStrict(data, config)
+	}
+	if nil != err {
+		return fmt.Errorf("Invalid config file '%s': %s", path, err)
+	}
+	return nil
+}
+
+/*
+env reads the settings defined by environment variables
+*/
+func (config *Config) env() error {
+	strs := map[string]*string{
+		"LISTEN":         &config.Listen,
+		"CHROME_BINARY":  &config.Chrome.Binary,
+		"PROXY_SERVER":   &config.Chrome.Proxy,
+		"USER_AGENT":     &config.Chrome.UserAgent,
+		"WEBHOOK_SECRET": &config.Webhook.Secret,
+		"STORAGE":        &config.Storage.Backend,
+		"STORAGE_PATH":   &config.Storage.Path,
+		"S3_ENDPOINT":    &config.Storage.S3.Endpoint,
+		"S3_REGION":      &config.Storage.S3.Region,
+		"S3_BUCKET":      &config.Storage.S3.Bucket,
+		"S3_ACCESS_KEY":  &config.Storage.S3.AccessKey,
+		"S3_SECRET_KEY":  &config.Storage.S3.SecretKey,
+	}
+	for name, value := range strs {
+		if env := os.Getenv(name); "" != env {
+			*value = env
+		}
+	}
+
+	ints := map[string]*int{
+		"CHROME_PORT":           &config.Chrome.Port,
+		"HEALTH_CHECK_INTERVAL": &config.Chrome.HealthCheckInterval,
+		"POOL_SIZE":             &config.Pool.Size,
+		"POOL_QUEUE":            &config.Pool.Queue,
+		"RENDER_TIMEOUT":        &config.Render.Timeout,
+		"MAX_PAGE_HEIGHT":       &config.Render.MaxPageHeight,
+		"MAX_PAGE_WIDTH":        &config.Render.MaxPageWidth,
+		"MAX_BODY_SIZE":         &config.Render.MaxBodySize,
+		"MAX_BATCH_SIZE":        &config.Render.MaxBatchSize,
+		"CACHE_SIZE":            &config.Cache.Size,
+		"CACHE_TTL":             &config.Cache.TTL,
+		"JOB_TTL":               &config.Jobs.TTL,
+		"MAX_QUEUED_JOBS":       &config.Jobs.MaxQueued,
+		"WEBHOOK_ATTEMPTS":      &config.Webhook.Attempts,
+		"STORAGE_URL_TTL":       &config.Storage.URLTTL,
+	}
+	for name, value := range ints {
+		env := os.Getenv(name)
+		if "" == env {
+			continue
+		}
+		num, err := strconv.Atoi(env)
+		if nil != err {
+			return fmt.Errorf("Invalid %s '%s', must be an integer", name, env)
+		}
+		*value = num
+	}
+
+	if env := os.Getenv("CHROME_FLAGS"); "" != env {
+		config.Chrome.Flags = strings.Fields(env)
+	}
+	return nil
+}
+
+/*
+Validate checks that the settings are usable
+*/
+func (config *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(config.Listen); nil != err {
+		return fmt.Errorf("Invalid listen address '%s', must be 'host:port' or ':port'", config.Listen)
+	}
+
+	if 1 > config.Chrome.Port || 65535 < config.Chrome.Port {
+		return fmt.Errorf("Invalid chrome.port '%d', must be between 1 and 65535", config.Chrome.Port)
+	}
+	if "" != config.Chrome.Binary {
+		if info, err := os.Stat(config.Chrome.Binary); nil != err || info.IsDir() {
+			return fmt.Errorf("Invalid chrome.binary '%s', must be the path to the Chrome executable", config.Chrome.Binary)
+		}
+	}
+	for _, flag := range config.Chrome.Flags {
+		if "" == strings.TrimLeft(strings.SplitN(flag, "=", 2)[0], "-") {
+			return fmt.Errorf("Invalid chrome.flags '%s', must be in the form '--name' or '--name=value'", flag)
+		}
+	}
+
+	if "" != config.Chrome.Proxy {
+		if parsed, err := url.Parse(config.Chrome.Proxy); nil != err || "" == parsed.Scheme || "" == parsed.Host {
+			return fmt.Errorf("Invalid chrome.proxy '%s', must be a URL such as 'http://proxy:3128'", config.Chrome.Proxy)
+		}
+	}
+
+	positive := []struct {
+		name  string
+		value int
+	}{
+		{"chrome.health_check_interval", config.Chrome.HealthCheckInterval},
+		{"pool.size", config.Pool.Size},
+		{"pool.queue", config.Pool.Queue},
+		{"render.timeout", config.Render.Timeout},
+		{"render.max_page_height", config.Render.MaxPageHeight},
+		{"render.max_page_width", config.Render.MaxPageWidth},
+		{"render.max_body_size", config.Render.MaxBodySize},
+		{"render.max_batch_size", config.Render.MaxBatchSize},
+		{"cache.size", config.Cache.Size},
+		{"cache.ttl", config.Cache.TTL},
+		{"jobs.ttl", config.Jobs.TTL},
+		{"jobs.max_queued", config.Jobs.MaxQueued},
+		{"webhook.attempts", config.Webhook.Attempts},
+		{"storage.url_ttl", config.Storage.URLTTL},
+	}
+	for _, setting := range positive {
+		if 1 > setting.value {
+			return fmt.Errorf("Invalid %s '%d', must be a positive integer", setting.name, setting.value)
+		}
+	}
+
+	// The backend settings are checked when the backend is created
+	switch config.Storage.Backend {
+	case "", "local", "s3":
+	default:
+		return fmt.Errorf("Invalid storage.backend '%s', must be either 'local' or 's3'", config.Storage.Backend)
+	}
+
+	return nil
+}
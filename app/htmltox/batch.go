@@ -0,0 +1,194 @@
+package htmltox
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+BatchItem is the result of rendering one URL in a batch
+*/
+type BatchItem struct {
+	URL         string     `json:"url"`
+	Status      int        `json:"status"`
+	ContentType string     `json:"content_type,omitempty"`
+	Data        string     `json:"data,omitempty"`
+	Error       *api.Error `json:"error,omitempty"`
+
+	result *Result
+}
+
+/*
+RenderBatch renders several URLs in parallel and returns a result for each, in
+the same order. Failed renders are reported in the item's Status and Error.
+*/
+func (htmltox *HTMLToX) RenderBatch(ctx context.Context, options *RenderOptions, urls []string) []*BatchItem {
+	items := make([]*BatchItem, len(urls))
+
+	// Don't flood the pool queue with a single batch
+	slots := make(chan struct{}, htmltox.Pool.Size())
+	wg := sync.WaitGroup{}
+	for a, target := range urls {
+		items[a] = &BatchItem{URL: target}
+		wg.Add(1)
+		go func(item *BatchItem) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			result, err := htmltox.Render(ctx, options, Source{URL: item.URL})
+			if nil != err {
+				log.Errorf("Batch render of '%s' failed: %s", item.URL, err)
+				item.Error = renderError(err)
+				item.Status = item.Error.Status
+				return
+			}
+			item.Status = 200
+			item.ContentType = result.ContentType
+			item.result = result
+		}(items[a])
+	}
+	wg.Wait()
+
+	return items
+}
+
+/*
+renderBatch renders the 'url' options and writes the results as the response
+*/
+func (htmltox *HTMLToX) renderBatch(
+	response http.ResponseWriter,
+	request *http.Request,
+	options *RenderOptions,
+) {
+	err := htmltox.checkStore(options)
+	var result *Result
+	if nil == err {
+		result, err = batchResult(htmltox.RenderBatch(request.Context(), options, options.URLs), options)
+	}
+	if nil == err {
+		result, err = htmltox.store(result, options)
+	}
+	if nil != err {
+		htmltox.API.RespondWithError(request, response, renderError(err))
+		return
+	}
+
+	headers := cacheHeaders(result, options)
+	if "application/zip" == result.ContentType {
+		headers["Content-Disposition"] = `attachment; filename="htmltox.zip"`
+	}
+	htmltox.respondWithResult(response, request, result, headers)
+}
+
+/*
+batchResult combines the batch items into a single result, either a JSON array
+of base64 encoded results or a ZIP archive
+*/
+func batchResult(items []*BatchItem, options *RenderOptions) (*Result, error) {
+	if "zip" == options.Output {
+		archive, err := zipBatch(items, options.Format)
+		if nil != err {
+			return nil, err
+		}
+		return &Result{Data: archive, ContentType: "application/zip", Status: batchStatus(items)}, nil
+	}
+
+	for _, item := range items {
+		if nil != item.result {
+			item.Data = base64.StdEncoding.EncodeToString(item.result.Data)
+		}
+	}
+	data, err := json.Marshal(items)
+	if nil != err {
+		return nil, err
+	}
+	return &Result{Data: data, ContentType: "application/json", Status: batchStatus(items)}, nil
+}
+
+/*
+batchStatus returns the response status of a batch: 200 if every render
+succeeded, 207 if only some did, and otherwise the status the failed renders
+share, or 502 if their statuses differ
+*/
+func batchStatus(items []*BatchItem) int {
+	succeeded, status := 0, 0
+	for _, item := range items {
+		switch {
+		case nil != item.result:
+			succeeded++
+		case 0 == status:
+			status = item.Status
+		case status != item.Status:
+			status = 502
+		}
+	}
+	switch succeeded {
+	case len(items):
+		return 200
+	case 0:
+		return status
+	}
+	return 207
+}
+
+/*
+zipBatch returns a ZIP archive containing a file for each successful render and
+a manifest.json file listing the status of every item
+*/
+func zipBatch(items []*BatchItem, format string) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	archive := zip.NewWriter(buffer)
+
+	extension := format
+	if "jpeg" == format {
+		extension = "jpg"
+	}
+
+	manifest := make([]map[string]interface{}, 0, len(items))
+	for a, item := range items {
+		entry := map[string]interface{}{
+			"url":    item.URL,
+			"status": item.Status,
+		}
+		if nil == item.result {
+			entry["error"] = item.Error
+			manifest = append(manifest, entry)
+			continue
+		}
+
+		name := fmt.Sprintf("%03d.%s", a+1, extension)
+		file, err := archive.Create(name)
+		if nil != err {
+			return nil, err
+		}
+		if _, err := file.Write(item.result.Data); nil != err {
+			return nil, err
+		}
+		entry["file"] = name
+		manifest = append(manifest, entry)
+	}
+
+	file, err := archive.Create("manifest.json")
+	if nil != err {
+		return nil, err
+	}
+	if err := json.NewEncoder(file).Encode(manifest); nil != err {
+		return nil, err
+	}
+
+	if err := archive.Close(); nil != err {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
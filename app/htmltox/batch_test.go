@@ -0,0 +1,39 @@
+package htmltox
+
+import (
+	"testing"
+)
+
+/*
+TestBatchStatus checks the response status for batches of successful and
+failed renders
+*/
+func TestBatchStatus(t *testing.T) {
+	done := &BatchItem{Status: 200, result: &Result{}}
+	timeout := &BatchItem{Status: 504}
+	invalid := &BatchItem{Status: 422}
+
+	tests := []struct {
+		name   string
+		items  []*BatchItem
+		status int
+	}{
+		{"all succeeded", []*BatchItem{done, done}, 200},
+		{"some failed", []*BatchItem{done, timeout}, 207},
+		{"all failed alike", []*BatchItem{timeout, timeout}, 504},
+		{"all failed differently", []*BatchItem{timeout, invalid}, 502},
+	}
+	for _, test := range tests {
+		if status := batchStatus(test.items); test.status != status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+		}
+	}
+
+	result, err := batchResult([]*BatchItem{timeout}, &RenderOptions{Output: "zip", Format: "png"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 504 != result.status() {
+		t.Errorf("Expected a failed zip batch to have status 504, got %d", result.status())
+	}
+}
@@ -0,0 +1,130 @@
+package htmltox
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+/*
+Cache is an in-memory LRU cache of render results
+
+Entries expire after the ttl period and the least recently used entries are
+evicted when the total size of the cached output exceeds maxSize bytes.
+*/
+type Cache struct {
+	maxSize int
+	ttl     time.Duration
+
+	mux     sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+/*
+cacheEntry is a cached result
+*/
+type cacheEntry struct {
+	key     string
+	result  *Result
+	expires time.Time
+}
+
+/*
+NewCache returns a pointer to a Cache of up to maxSize bytes
+*/
+func NewCache(maxSize int, ttl time.Duration) *Cache {
+	return &Cache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+/*
+TTL returns how long results are cached
+*/
+func (cache *Cache) TTL() time.Duration {
+	return cache.ttl
+}
+
+/*
+Get returns the cached result for a key
+*/
+func (cache *Cache) Get(key string) (*Result, bool) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		cache.remove(element)
+		return nil, false
+	}
+	cache.lru.MoveToFront(element)
+	return entry.result, true
+}
+
+/*
+Set caches a result, evicting the least recently used results to make room.
+Results larger than the cache are not cached.
+*/
+func (cache *Cache) Set(key string, result *Result) {
+	if len(result.Data) > cache.maxSize {
+		return
+	}
+
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		cache.remove(element)
+	}
+	cache.entries[key] = cache.lru.PushFront(&cacheEntry{
+		key:     key,
+		result:  result,
+		expires: time.Now().Add(cache.ttl),
+	})
+	cache.size += len(result.Data)
+
+	for cache.size > cache.maxSize {
+		cache.remove(cache.lru.Back())
+	}
+}
+
+/*
+remove deletes an entry. The lock must be held.
+*/
+func (cache *Cache) remove(element *list.Element) {
+	entry := cache.lru.Remove(element).(*cacheEntry)
+	delete(cache.entries, entry.key)
+	cache.size -= len(entry.result.Data)
+}
+
+/*
+cacheKey returns a hash of the normalized render options and the source, which
+contains the HTML content for HTML renders. The 'nocache' and 'store' options
+don't affect the rendered output and are left out.
+*/
+func cacheKey(options *RenderOptions, source Source) string {
+	keyed := *options
+	keyed.NoCache = false
+	keyed.Store = false
+	encoded, _ := json.Marshal(keyed)
+
+	hash := sha256.New()
+	hash.Write([]byte(source.URL))
+	hash.Write([]byte{0})
+	hash.Write([]byte(source.HTML))
+	hash.Write([]byte{0})
+	hash.Write(encoded)
+	return hex.EncodeToString(hash.Sum(nil))
+}
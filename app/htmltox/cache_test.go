@@ -0,0 +1,104 @@
+package htmltox
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+TestCacheEviction checks that the least recently used results are evicted when
+the cache is full
+*/
+func TestCacheEviction(t *testing.T) {
+	cache := NewCache(10, time.Minute)
+	cache.Set("a", &Result{Data: []byte("aaaa")})
+	cache.Set("b", &Result{Data: []byte("bbbb")})
+
+	// Using 'a' leaves 'b' as the least recently used result
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("Expected 'a' to be cached")
+	}
+	cache.Set("c", &Result{Data: []byte("cccc")})
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("Expected 'b' to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("Expected '%s' to be cached", key)
+		}
+	}
+	if 8 != cache.size {
+		t.Errorf("Expected a cache size of 8, got %d", cache.size)
+	}
+
+	// Replacing a result doesn't count it twice
+	cache.Set("a", &Result{Data: []byte("aa")})
+	if 6 != cache.size {
+		t.Errorf("Expected a cache size of 6, got %d", cache.size)
+	}
+}
+
+/*
+TestCacheOversized checks that results larger than the cache aren't cached and
+don't evict other results
+*/
+func TestCacheOversized(t *testing.T) {
+	cache := NewCache(4, time.Minute)
+	cache.Set("a", &Result{Data: []byte("aaaa")})
+	cache.Set("b", &Result{Data: []byte("bbbbb")})
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("Expected 'b' not to be cached")
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Error("Expected 'a' to be cached")
+	}
+}
+
+/*
+TestCacheTTL checks that results expire
+*/
+func TestCacheTTL(t *testing.T) {
+	cache := NewCache(10, 20*time.Millisecond)
+	cache.Set("a", &Result{Data: []byte("aaaa")})
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("Expected 'a' to be cached")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := cache.Get("a"); ok {
+		t.Error("Expected 'a' to expire")
+	}
+	if 0 != cache.size || 0 != len(cache.entries) {
+		t.Errorf("Expected the expired result to be removed, got size %d", cache.size)
+	}
+}
+
+/*
+TestCacheKey checks that the key depends on the rendered output only
+*/
+func TestCacheKey(t *testing.T) {
+	options := &RenderOptions{Format: "png", Width: 800}
+	key := cacheKey(options, Source{URL: "http://example.com"})
+
+	if key != cacheKey(&RenderOptions{Format: "png", Width: 800, NoCache: true, Store: true}, Source{URL: "http://example.com"}) {
+		t.Error("Expected 'nocache' and 'store' not to change the key")
+	}
+
+	tests := map[string]struct {
+		options *RenderOptions
+		source  Source
+	}{
+		"format":  {&RenderOptions{Format: "jpeg", Width: 800}, Source{URL: "http://example.com"}},
+		"width":   {&RenderOptions{Format: "png", Width: 801}, Source{URL: "http://example.com"}},
+		"url":     {options, Source{URL: "http://example.org"}},
+		"html":    {options, Source{HTML: "http://example.com"}},
+		"content": {options, Source{URL: "http://example.com", HTML: "<p>"}},
+	}
+	for name, test := range tests {
+		if key == cacheKey(test.options, test.source) {
+			t.Errorf("Expected a different key for a different %s", name)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package htmltox
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+	"github.com/mkenney/go-chrome/cdtp/emulation"
+	"github.com/mkenney/go-chrome/cdtp/network"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Device describes an emulated device. Width and Height are the viewport size in
+CSS pixels.
+*/
+type Device struct {
+	Width     int
+	Height    int
+	Scale     float64
+	Mobile    bool
+	Touch     bool
+	UserAgent string
+}
+
+/*
+landscapeSuffix is appended to a device name to rotate the device
+*/
+const landscapeSuffix = "-landscape"
+
+/*
+devices lists the presets accepted by the 'device' parameter. Mobile devices
+are in their natural portrait orientation.
+*/
+var devices = map[string]Device{
+	"desktop": {
+		Width:  1440,
+		Height: 900,
+		Scale:  1,
+	},
+	"desktop-hd": {
+		Width:  1920,
+		Height: 1080,
+		Scale:  1,
+	},
+	"desktop-retina": {
+		Width:  1440,
+		Height: 900,
+		Scale:  2,
+	},
+	"ipad": {
+		Width:     768,
+		Height:    1024,
+		Scale:     2,
+		Mobile:    true,
+		Touch:     true,
+		UserAgent: "Mozilla/5.0 (iPad; CPU OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1",
+	},
+	"ipad-pro": {
+		Width:     1024,
+		Height:    1366,
+		Scale:     2,
+		Mobile:    true,
+		Touch:     true,
+		UserAgent: "Mozilla/5.0 (iPad; CPU OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1",
+	},
+	"iphone": {
+		Width:     390,
+		Height:    844,
+		Scale:     3,
+		Mobile:    true,
+		Touch:     true,
+		UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1",
+	},
+	"iphone-se": {
+		Width:     375,
+		Height:    667,
+		Scale:     2,
+		Mobile:    true,
+		Touch:     true,
+		UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1",
+	},
+	"pixel": {
+		Width:     412,
+		Height:    915,
+		Scale:     2.625,
+		Mobile:    true,
+		Touch:     true,
+		UserAgent: "Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Mobile Safari/537.36",
+	},
+}
+
+/*
+validateDeviceOptions validates the 'device' option
+
+Any preset may be rotated by adding '-landscape' to its name, e.g.
+'iphone-landscape'.
+*/
+func validateDeviceOptions(options *RenderOptions) error {
+	name := strings.ToLower(strings.TrimSpace(options.Device))
+	if _, ok := devices[strings.TrimSuffix(name, landscapeSuffix)]; "" != name && !ok {
+		names := make([]string, 0, len(devices))
+		for name := range devices {
+			names = append(names, "'"+name+"'")
+		}
+		sort.Strings(names)
+		return api.InvalidParam("device", "Invalid device '%s', must be one of %s", name, strings.Join(names, ", "))
+	}
+	options.Device = name
+
+	return nil
+}
+
+/*
+getDevice returns the emulated device, the 'device' preset with the 'width',
+'height' and 'scale' options applied on top of it. Without a preset the
+viewport is defaultViewportSize square.
+*/
+func getDevice(options *RenderOptions) Device {
+	name := options.Device
+	device, ok := devices[strings.TrimSuffix(name, landscapeSuffix)]
+	if !ok {
+		device = Device{
+			Width:  defaultViewportSize,
+			Height: defaultViewportSize,
+			Scale:  1,
+		}
+	}
+	if strings.HasSuffix(name, landscapeSuffix) {
+		device.Width, device.Height = device.Height, device.Width
+	}
+
+	if options.Width > 0 {
+		device.Width = options.Width
+	}
+	if options.Height > 0 {
+		device.Height = options.Height
+	}
+
+	// The 'scale' option is the print scale for PDF documents
+	if "pdf" != options.Format && options.Scale > 0 {
+		device.Scale = options.Scale
+	}
+	return device
+}
+
+/*
+orientation returns the screen orientation of the device, portrait when it is
+taller than it is wide. Both are primary orientations, with an angle of 0.
+*/
+func (device Device) orientation() *emulation.ScreenOrientation {
+	if device.Height > device.Width {
+		return &emulation.ScreenOrientation{Type: "portraitPrimary", Angle: 0}
+	}
+	return &emulation.ScreenOrientation{Type: "landscapePrimary", Angle: 0}
+}
+
+/*
+setDevice enables touch emulation and sets the user-agent of the emulated
+device. They are reset when the tab is released.
+*/
+func setDevice(ctx context.Context, tab *Tab, options *RenderOptions) error {
+	device := getDevice(options)
+
+	if device.Touch {
+		tab.touch = true
+		var touchResult *emulation.SetTouchEmulationEnabledResult
+		if err := await(ctx, tab.Emulation().SetTouchEmulationEnabled(&emulation.SetTouchEmulationEnabledParams{
+			Enabled:        true,
+			MaxTouchPoints: 5,
+		}), &touchResult); nil != err {
+			return err
+		}
+		if nil != touchResult.CDTPError {
+			log.Errorf("Emulation.setTouchEmulationEnabled: %s", touchResult.CDTPError.Error())
+			return touchResult.CDTPError
+		}
+	}
+
+	if "" != device.UserAgent {
+		tab.userAgent = true
+		var userAgentResult *network.SetUserAgentOverrideResult
+		if err := await(ctx, tab.Network().SetUserAgentOverride(&network.SetUserAgentOverrideParams{
+			UserAgent: device.UserAgent,
+		}), &userAgentResult); nil != err {
+			return err
+		}
+		if nil != userAgentResult.CDTPError {
+			log.Errorf("Network.setUserAgentOverride: %s", userAgentResult.CDTPError.Error())
+			return userAgentResult.CDTPError
+		}
+	}
+
+	return nil
+}
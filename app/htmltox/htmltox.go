@@ -5,20 +5,22 @@ Chrome browser
 package htmltox
 
 import (
-	"encoding/base64"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mkenney/docker-htmltox/app/api"
-	chrome "github.com/mkenney/go-chrome"
-	"github.com/mkenney/go-chrome/cdtp/emulation"
-	"github.com/mkenney/go-chrome/cdtp/page"
-	"github.com/mkenney/go-chrome/socket"
+	"github.com/mkenney/docker-htmltox/app/config"
+	"github.com/mkenney/docker-htmltox/app/storage"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -27,43 +29,68 @@ import (
 HTMLToX defines the struct for the HTML conversion API service
 */
 type HTMLToX struct {
-	Browser chrome.Chromium
-	Sockets map[string]socket.Socketer
-	API     *api.API
+	Supervisor *Supervisor
+	Pool       *Pool
+	Jobs       *Jobs
+	Webhook    *Webhook
+	Storage    storage.Storage
+	Cache      *Cache
+	API        *api.API
+
+	// Config contains the service settings
+	Config *config.Config
 }
 
 /*
-New returns a pointer to an HTMLToX struct
+New returns a pointer to an HTMLToX struct configured by cfg
 */
-func New() (*HTMLToX, error) {
+func New(cfg *config.Config) (*HTMLToX, error) {
 	var err error
 
 	htmltox := &HTMLToX{
-		API: api.New(),
-		Browser: chrome.New(&chrome.Flags{
-			"addr":               []interface{}{"localhost"},
-			"disable-extensions": nil,
-			"disable-gpu":        nil,
-			"headless":           nil,
-			"hide-scrollbars":    nil,
-			"no-first-run":       nil,
-			"no-sandbox":         nil,
-			"port":               []interface{}{9222},
-			"remote-debugging-address": []interface{}{"0.0.0.0"},
-			"remote-debugging-port":    []interface{}{9222},
-		}, "", "", "", ""),
-		Sockets: make(map[string]socket.Socketer),
-	}
-
-	err = htmltox.Browser.Launch()
+		API:    api.New(),
+		Config: cfg,
+	}
+
+	// Credentials sent as query parameters are masked in the request logs
+	htmltox.API.SecretParams("header", "cookie", "password")
+
+	htmltox.Cache = NewCache(cfg.Cache.Size<<20, time.Duration(cfg.Cache.TTL)*time.Second)
+	htmltox.Storage, err = getStorage(cfg.Storage)
+	if nil != err {
+		return nil, err
+	}
+
+	htmltox.Pool = NewPool(cfg.Pool.Size, cfg.Pool.Queue)
+	htmltox.Webhook = NewWebhook(cfg.Webhook.Secret, cfg.Webhook.Attempts, time.Second)
+	htmltox.Jobs = NewJobs(cfg.Pool.Size, cfg.Jobs.MaxQueued, time.Duration(cfg.Jobs.TTL)*time.Second, htmltox.Webhook)
+	htmltox.Supervisor = NewSupervisor(
+		chromeFlags(cfg.Chrome),
+		cfg.Chrome.Binary,
+		fmt.Sprintf("http://localhost:%d", cfg.Chrome.Port),
+		time.Duration(cfg.Chrome.HealthCheckInterval)*time.Second,
+		htmltox.Pool,
+	)
+
+	err = htmltox.Supervisor.Launch()
 	if nil != err {
 		log.Error(err)
 		return nil, err
 	}
 
-	htmltox.API.Handle("GET", "/", htmltox.Usage)
-	htmltox.API.Handle("GET", "/test", htmltox.RenderURL)
-	htmltox.API.Handle("GET", "/favicon.ico", func(response http.ResponseWriter, request *http.Request) {
+	// Render results may be cached by clients for as long as the render
+	// cache keeps them
+	renderPolicy := fmt.Sprintf("public, max-age=%d", cfg.Cache.TTL)
+	htmltox.API.HandleWithCachePolicy("GET", "/", "public, max-age=3600", htmltox.Usage)
+	htmltox.API.HandleWithCachePolicy("GET", "/options", "public, max-age=3600", htmltox.Schema)
+	htmltox.API.HandleWithCachePolicy("GET", "/test", renderPolicy, htmltox.RenderURL)
+	htmltox.API.HandleWithCachePolicy("POST", "/test", renderPolicy, htmltox.RenderURL)
+	htmltox.API.HandleWithCachePolicy("POST", "/image", renderPolicy, htmltox.RenderHTML)
+	htmltox.API.HandleWithCachePolicy("POST", "/pdf", renderPolicy, htmltox.RenderPDF)
+	htmltox.API.Handle("POST", "/jobs", htmltox.CreateJob)
+	htmltox.API.Handle("GET", "/jobs/{id}", htmltox.GetJob)
+	htmltox.API.Handle("GET", "/jobs/{id}/result", htmltox.GetJobResult)
+	htmltox.API.HandleWithCachePolicy("GET", "/favicon.ico", "public, max-age=86400", func(response http.ResponseWriter, request *http.Request) {
 		data, err := ioutil.ReadFile("/go/src/github.com/mkenney/docker-htmltox/app/assets/favicon.ico")
 		if nil != err {
 			log.Debugf(err.Error())
@@ -79,26 +106,50 @@ func New() (*HTMLToX, error) {
 			headers,
 		)
 	})
+	htmltox.API.NotFoundHandler(func(response http.ResponseWriter, request *http.Request) {
+		htmltox.API.RespondWithError(request, response, api.NewError(404, api.CodeNotFound, "No route for %s %s", request.Method, request.URL.Path))
+	})
 
 	return htmltox, nil
 }
 
+/*
+getStorage returns the configured storage backend, either "local" or "s3", or
+nil if storage is disabled
+*/
+func getStorage(cfg config.Storage) (storage.Storage, error) {
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case "local":
+		return storage.NewLocal(cfg.Path)
+	case "s3":
+		return storage.NewS3(
+			cfg.S3.Endpoint,
+			cfg.S3.Region,
+			cfg.S3.Bucket,
+			cfg.S3.AccessKey,
+			cfg.S3.SecretKey,
+		)
+	}
+	return nil, fmt.Errorf("Invalid storage backend '%s', must be either 'local' or 's3'", cfg.Backend)
+}
+
+/*
+usageFile is the usage page template
+*/
+const usageFile = "/go/src/github.com/mkenney/docker-htmltox/app/usage.html"
+
 /*
 Usage returns usage information
 */
 func (htmltox *HTMLToX) Usage(response http.ResponseWriter, request *http.Request) {
 	headers := make(map[string]string)
-	content, err := ioutil.ReadFile("/go/src/github.com/mkenney/docker-htmltox/app/usage.html")
+	content, err := usage()
 	if err != nil {
-		log.Error(err)
-		htmltox.API.RespondWithErrorBody(
-			request,
-			response,
-			500,
-			fmt.Sprintf("%s", err),
-			headers,
-		)
+		htmltox.API.RespondWithError(request, response, err)
 	} else {
+		headers["ETag"] = api.ETag(content)
 		htmltox.API.RespondWithRawBody(
 			request,
 			response,
@@ -109,8 +160,27 @@ func (htmltox *HTMLToX) Usage(response http.ResponseWriter, request *http.Reques
 	}
 }
 
+/*
+usage renders the usage page, with the table of render options generated from
+their documentation
+*/
+func usage() ([]byte, error) {
+	page, err := template.ParseFiles(usageFile)
+	if nil != err {
+		return nil, err
+	}
+	buffer := &bytes.Buffer{}
+	err = page.Execute(buffer, struct {
+		Options []OptionDoc
+	}{
+		Options: OptionsSchema(),
+	})
+	return buffer.Bytes(), err
+}
+
 /*
 RenderURL takes a URL as the HTML source and returns a byte array of the resulting image
+or PDF document
 
 @param source An HTML string or URL
 @param format An output format, one of 'jpg', 'png', 'pdf'
@@ -134,280 +204,249 @@ func (htmltox *HTMLToX) RenderURL(response http.ResponseWriter, request *http.Re
 	//	return
 	//}
 
-	queryParams, err := getParams(request)
-	tmp, _ := json.Marshal(queryParams)
-	log.Debugf("Query params: %s", string(tmp))
+	options, err := htmltox.getOptions(request)
+	if nil == err && 0 == len(options.URLs) {
+		err = api.InvalidParam("url", "The 'url' param is required")
+	}
 	if nil != err {
-		htmltox.API.RespondWithErrorBody(
-			request,
-			response,
-			400,
-			fmt.Errorf("%s", "Failed to parse query params"),
-			make(map[string]string),
-		)
+		htmltox.API.RespondWithError(request, response, err)
 		return
 	}
 
-	tab, err := htmltox.Browser.NewTab(queryParams["url"][0])
+	if len(options.URLs) > 1 || "" != options.Output {
+		htmltox.renderBatch(response, request, options)
+		return
+	}
+	htmltox.render(response, request, options, Source{URL: options.URLs[0]})
+}
+
+/*
+RenderHTML takes an HTML document from the request body and returns a byte array
+of the resulting image
+
+The body may either be the raw HTML document, sent as 'text/html', or a JSON
+object with an 'html' property. Any other properties of a JSON body are treated
+as query parameters.
+*/
+func (htmltox *HTMLToX) RenderHTML(response http.ResponseWriter, request *http.Request) {
+	html, options, err := htmltox.getHTMLOptions(request)
+	if nil == err && "pdf" == options.Format {
+		err = api.InvalidParam("format", "Invalid format 'pdf', use the /pdf endpoint to render PDF documents")
+	}
+	if nil == err {
+		err = htmltox.validateOptions(options)
+	}
 	if nil != err {
-		log.Error(err)
-		htmltox.API.RespondWithErrorBody(
-			request,
-			response,
-			500,
-			err.Error(),
-			make(map[string]string),
-		)
+		htmltox.API.RespondWithError(request, response, err)
 		return
 	}
 
-	// Enable Page events
-	enableResult := <-tab.Page().Enable()
-	if nil != enableResult.CDTPError {
-		log.Errorf("Page.Enable: %s", enableResult.CDTPError.Error())
-		htmltox.API.RespondWithErrorBody(
-			request,
-			response,
-			500,
-			fmt.Sprintf("%s", enableResult.CDTPError),
-			make(map[string]string),
-		)
+	htmltox.render(response, request, options, Source{HTML: html})
+}
+
+/*
+RenderPDF takes an HTML document from the request body and returns the resulting
+PDF document
+
+The body is read the same way as RenderHTML. The 'format' parameter is always
+'pdf' and the PDF options (paper, margins, orientation, header and footer
+templates, scale, etc.) are accepted as query parameters or JSON properties.
+*/
+func (htmltox *HTMLToX) RenderPDF(response http.ResponseWriter, request *http.Request) {
+	html, options, err := htmltox.getHTMLOptions(request)
+	if nil == err && "" != options.Format && "pdf" != options.Format {
+		err = api.InvalidParam("format", "Invalid format '%s', the /pdf endpoint only renders the 'pdf' format", options.Format)
+	}
+	if nil == err {
+		options.Format = "pdf"
+		err = htmltox.validateOptions(options)
+	}
+	if nil != err {
+		htmltox.API.RespondWithError(request, response, err)
 		return
 	}
 
-	emulationSizeResult := <-tab.Emulation().SetVisibleSize(&emulation.SetVisibleSizeParams{
-		Width:  1440,
-		Height: 1440,
-	})
-	if nil != emulationSizeResult.CDTPError {
-		log.Error(emulationSizeResult.CDTPError)
-	}
-
-	// Set the viewport stuff
-	emulationDeviceResult := <-tab.Emulation().SetDeviceMetricsOverride(&emulation.SetDeviceMetricsOverrideParams{
-		Width:  1440,
-		Height: 1440,
-		ScreenOrientation: &emulation.ScreenOrientation{
-			Type:  "portraitPrimary",
-			Angle: 90,
-		},
-	})
-	if nil != emulationDeviceResult.CDTPError {
-		log.Errorf("Emulation.SetDeviceMetricsOverride: %s", emulationDeviceResult.CDTPError.Error())
-	}
-
-	screenshotCaptureStarted := false
-	screenshotCaptured := false
-	screenshotReturned := make(chan bool)
-	renderScreenshot := func() string {
-		screenshotCaptureStarted = true
-		result := <-tab.Page().CaptureScreenshot(&page.CaptureScreenshotParams{
-			Format: queryParams["format"][0],
-		})
-		if nil != result.CDTPError {
-			log.Errorf("Page.CaptureScreenshot: %s", result.CDTPError.Error())
-			htmltox.API.RespondWithErrorBody(
-				request,
-				response,
-				500,
-				fmt.Sprintf("%s", err),
-				make(map[string]string),
-			)
-			return ""
-		}
-		log.Debugf("Screenshot rendered")
-		return result.Data
+	htmltox.render(response, request, options, Source{HTML: html})
+}
+
+/*
+Schema returns the documentation of the render options
+*/
+func (htmltox *HTMLToX) Schema(response http.ResponseWriter, request *http.Request) {
+	htmltox.API.RespondWithJSONBody(
+		request,
+		response,
+		200,
+		OptionsSchema(),
+		make(map[string]string),
+	)
+}
+
+/*
+readParams reads the render parameters of a request from the query string and,
+for POST requests, the request body. It returns the HTML content of the body,
+if any.
+*/
+func (htmltox *HTMLToX) readParams(request *http.Request) (url.Values, string, error) {
+	params, err := url.ParseQuery(request.URL.RawQuery)
+	if nil != err {
+		return nil, "", api.NewError(400, api.CodeInvalidParam, "Invalid query string: %s", err)
+	}
+	if "POST" != request.Method {
+		return params, "", nil
 	}
+	html, err := htmltox.readBody(request, params)
+	if nil != err {
+		return nil, "", err
+	}
+	return params, html, nil
+}
 
-	returnScreenshot := func(data string) {
-		bytes, err := base64.StdEncoding.DecodeString(data)
-		if nil != err {
-			htmltox.API.RespondWithErrorBody(
-				request,
-				response,
-				500,
-				fmt.Sprintf("%s", err),
-				make(map[string]string),
-			)
-		}
-		headers := make(map[string]string)
-		headers["Content-Type"] = fmt.Sprintf("image/%s", queryParams["format"][0])
-		htmltox.API.RespondWithRawBody(
-			request,
-			response,
-			200,
-			string(bytes),
-			headers,
-		)
-		screenshotReturned <- true
+/*
+getOptions reads and validates the render options of a request that renders
+URLs. POST requests may also send them as the properties of a JSON body or as
+form fields, which keeps credentials out of the request URL.
+*/
+func (htmltox *HTMLToX) getOptions(request *http.Request) (*RenderOptions, error) {
+	params, html, err := htmltox.readParams(request)
+	if nil != err {
+		return nil, err
+	} else if "" != strings.TrimSpace(html) {
+		return nil, api.NewError(400, api.CodeInvalidBody, "HTML content is not accepted here, use the /image or /pdf endpoints")
 	}
 
-	loadEventHandler := socket.NewEventHandler("Page.loadEventFired", func(response *socket.Response) {
-		if false == screenshotCaptureStarted {
-			returnScreenshot(renderScreenshot())
-			screenshotCaptured = true
-		}
-	})
-	tab.AddEventHandler(loadEventHandler)
+	options, err := DecodeOptions(params)
+	if nil != err {
+		return nil, err
+	}
+	return options, htmltox.validateOptions(options)
+}
 
-	// Don't wait too long
-	if "" == queryParams["timeout"][0] {
-		queryParams["timeout"][0] = "30"
+/*
+getHTMLOptions reads the HTML source and the unvalidated render options from a
+request that renders HTML content
+*/
+func (htmltox *HTMLToX) getHTMLOptions(request *http.Request) (string, *RenderOptions, error) {
+	params, html, err := htmltox.readParams(request)
+	if nil != err {
+		return "", nil, err
+	} else if "" == strings.TrimSpace(html) {
+		return "", nil, api.NewError(400, api.CodeInvalidBody, "The request body must contain an HTML document, or a JSON object with an 'html' property")
 	}
-	timeout, err := strconv.Atoi(queryParams["timeout"][0])
+
+	options, err := DecodeOptions(params)
 	if nil != err {
-		htmltox.API.RespondWithErrorBody(
-			request,
-			response,
-			500,
-			fmt.Sprintf("%s", err),
-			make(map[string]string),
-		)
+		return "", nil, err
 	}
+	return html, options, validateContentOptions(options)
+}
 
-	// Force a render after max time
-	maxUntil := time.Now().Add(time.Second * time.Duration(timeout))
-	for {
-		if true == screenshotCaptured {
-			break
-		} else if true == screenshotCaptureStarted {
-			if true == <-screenshotReturned {
-				break
-			}
-		} else if time.Now().Before(maxUntil) {
-			time.Sleep(1)
-		} else {
-			screenshotCaptureStarted = true
-			returnScreenshot(renderScreenshot())
-			screenshotCaptured = true
-		}
+/*
+validateOptions validates the render options against the configured limits
+*/
+func (htmltox *HTMLToX) validateOptions(options *RenderOptions) error {
+	if err := options.Validate(htmltox.Config.Render); nil != err {
+		return err
 	}
+	log.Debugf("Render options: %s", options)
+	return nil
 }
 
-func getParams(request *http.Request) (url.Values, error) {
-	params, err := url.ParseQuery(request.URL.RawQuery)
+/*
+readBody reads the request body and returns the HTML source, if any
+
+The 'html' property of a JSON body or a form is returned and any other
+properties or fields are added to params. All other bodies are treated as raw
+HTML.
+*/
+func (htmltox *HTMLToX) readBody(request *http.Request, params url.Values) (string, error) {
+	maxBodySize := htmltox.Config.Render.MaxBodySize
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, int64(maxBodySize)+1))
 	if nil != err {
-		return nil, err
+		return "", api.NewError(400, api.CodeInvalidBody, "Failed to read request body: %s", err)
+	} else if len(body) > maxBodySize {
+		return "", api.NewError(413, api.CodeTooLarge, "The request body may not exceed %d bytes", maxBodySize)
 	}
 
-	// format
-	// Must be either "png" or "jpeg". Default "png"
-	if _, ok := params["format"]; !ok || 0 == len(params["format"]) {
-		params["format"] = make([]string, 1)
-		params["format"][0] = "png"
-	} else if "jpg" == params["format"][0] {
-		params["format"][0] = "jpeg"
-	} else if "png" != params["format"][0] && "jpeg" != params["format"][0] && "pdf" != params["format"][0] {
-		return nil, fmt.Errorf("Invalid format '%s', must be either 'png', 'jpeg' or 'pdf'", params["format"])
-	} else if len(params["format"]) > 1 {
-		return nil, fmt.Errorf("Only one 'format' parameter is allowed")
-	}
-
-	// height
-	// Must be an integer. Must have only 1 value
-	if _, ok := params["height"]; !ok || 0 == len(params["height"]) {
-		params["height"] = make([]string, 1)
-		params["height"][0] = ""
-	} else if _, err := strconv.Atoi(params["height"][0]); err != nil {
-		log.Error(err)
-		return nil, fmt.Errorf("Invalid height '%s'", params["height"])
-	} else if len(params["height"]) > 1 {
-		return nil, fmt.Errorf("Only one 'height' parameter is allowed")
-	}
-
-	// quality
-	// Only applicable to the "jpeg" format. Must be an integer. Must have only 1 value
-	if _, ok := params["quality"]; "jpeg" == params["format"][0] && !ok {
-		params["quality"] = make([]string, 1)
-		params["quality"][0] = "100"
-	} else if "jpeg" != params["format"][0] && len(params["quality"]) > 0 {
-		return nil, fmt.Errorf("The 'quality' param only applies to the 'jpeg' format")
-	} else if len(params["quality"]) > 0 {
-		if _, err := strconv.Atoi(params["quality"][0]); err != nil {
-			log.Error(err)
-			return nil, fmt.Errorf("Invalid quality '%s'", params["quality"])
-		} else if len(params["quality"]) > 1 {
-			return nil, fmt.Errorf("Only one 'quality' parameter is allowed")
-		}
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if "application/x-www-form-urlencoded" == mediaType {
+		return readForm(body, params), nil
+	} else if "application/json" != mediaType {
+		return string(body), nil
 	}
 
-	// scale
-	// Must be an integer. Must have only 1 value
-	if _, ok := params["scale"]; !ok || 0 == len(params["scale"]) {
-		params["scale"] = make([]string, 1)
-		params["scale"][0] = "1"
-	} else if _, err := strconv.Atoi(params["scale"][0]); err != nil {
-		log.Error(err)
-		return nil, fmt.Errorf("Invalid scale '%s'", params["scale"])
-	} else if len(params["scale"]) > 1 {
-		return nil, fmt.Errorf("Only one 'scale' parameter is allowed")
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(body, &fields); nil != err {
+		return "", api.NewError(400, api.CodeInvalidBody, "Invalid JSON body: %s", err)
 	}
 
-	// timeout
-	// Must be an integer. Must have only 1 value
-	if _, ok := params["timeout"]; !ok || 0 == len(params["timeout"]) {
-		params["timeout"] = make([]string, 1)
-		params["timeout"][0] = ""
-	} else if _, err := strconv.Atoi(params["timeout"][0]); err != nil {
-		log.Error(err)
-		return nil, fmt.Errorf("Invalid timeout '%s'", params["timeout"])
-	} else if len(params["timeout"]) > 1 {
-		return nil, fmt.Errorf("Only one 'timeout' parameter is allowed")
+	html := ""
+	if _, ok := fields["html"]; ok {
+		if html, ok = fields["html"].(string); !ok {
+			return "", api.InvalidParam("html", "The 'html' property must contain an HTML document")
+		}
+		delete(fields, "html")
 	}
 
-	// url
-	// Must be a valid URL. Multiple values allowed unless "raw" is specified
-	if _, ok := params["url"]; !ok || 0 == len(params["url"]) {
-		params["url"] = make([]string, 1)
-		params["url"][0] = ""
-	} else {
-		for k, urlParam := range params["url"] {
-			if "/" != params["url"][k][len(params["url"][k])-1:] {
-				params["url"][k] += "/"
-			}
-			if _, err := url.ParseRequestURI(urlParam); nil != err {
-				return nil, fmt.Errorf("Invalid URL '%s'", urlParam)
+	for name, field := range fields {
+		values, ok := field.([]interface{})
+		if !ok {
+			values = []interface{}{field}
+		}
+		for _, value := range values {
+			switch value := value.(type) {
+			case string:
+				params.Add(name, value)
+			case float64:
+				params.Add(name, strconv.FormatFloat(value, 'f', -1, 64))
+			case bool:
+				params.Add(name, strconv.FormatBool(value))
+			case map[string]interface{}:
+				encoded, _ := json.Marshal(value)
+				params.Add(name, string(encoded))
+			default:
+				return "", api.InvalidParam(name, "Invalid %s '%v'", name, value)
 			}
 		}
 	}
 
-	// width
-	// Must be an integer. Must have only 1 value
-	if _, ok := params["width"]; !ok || 0 == len(params["width"]) {
-		params["width"] = make([]string, 1)
-		params["width"][0] = ""
-	} else if _, err := strconv.Atoi(params["width"][0]); err != nil {
-		log.Error(err)
-		return nil, fmt.Errorf("Invalid width '%s'", params["width"])
-	} else if len(params["width"]) > 1 {
-		return nil, fmt.Errorf("Only one 'width' parameter is allowed")
-	}
+	return html, nil
+}
 
-	// x-offset
-	// Must be an integer. Must have only 1 value
-	if _, ok := params["x-offset"]; !ok || 0 == len(params["x-offset"]) {
-		params["x-offset"] = make([]string, 1)
-		params["x-offset"][0] = ""
-	} else if _, err := strconv.Atoi(params["x-offset"][0]); err != nil {
-		log.Error(err)
-		return nil, fmt.Errorf("Invalid x-offset '%s'", params["x-offset"])
-	} else if len(params["x-offset"]) > 1 {
-		return nil, fmt.Errorf("Only one 'x-offset' parameter is allowed")
+/*
+readForm adds the fields of a form body to params and returns its 'html' field
+
+HTML documents are often posted with the form content type by clients that
+default to it, so bodies that contain anything but known fields are treated as
+raw HTML.
+*/
+func readForm(body []byte, params url.Values) string {
+	fields, err := url.ParseQuery(string(body))
+	if nil != err {
+		return string(body)
+	}
+	for name := range fields {
+		if "html" != name && "callback_url" != name && "callback_body" != name && !knownParam(name) {
+			return string(body)
+		}
 	}
 
-	// y-offset
-	// Must be an integer. Must have only 1 value
-	if _, ok := params["y-offset"]; !ok || 0 == len(params["y-offset"]) {
-		params["y-offset"] = make([]string, 1)
-		params["y-offset"][0] = ""
-	} else if _, err := strconv.Atoi(params["y-offset"][0]); err != nil {
-		log.Error(err)
-		return nil, fmt.Errorf("Invalid y-offset '%s'", params["y-offset"])
-	} else if len(params["y-offset"]) > 1 {
-		return nil, fmt.Errorf("Only one 'y-offset' parameter is allowed")
+	html := fields.Get("html")
+	delete(fields, "html")
+	for name, values := range fields {
+		params[name] = append(params[name], values...)
 	}
+	return html
+}
 
-	return params, nil
+/*
+contentType returns the response Content-Type for an output format
+*/
+func contentType(format string) string {
+	if "pdf" == format {
+		return "application/pdf"
+	}
+	return fmt.Sprintf("image/%s", format)
 }
 
 //func getHandler(params url.Values, api *api.API, response http.ResponseWriter) (func(results []chrome.SocketScreenshotResult), error) {
@@ -0,0 +1,458 @@
+package htmltox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+	"github.com/mkenney/docker-htmltox/app/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Job statuses
+*/
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+/*
+ErrJobsFull is returned by Jobs.Add when the maximum number of unfinished jobs
+is reached
+*/
+var ErrJobsFull = errors.New("Too many queued jobs, try again later")
+
+/*
+Job is an asynchronous render job
+*/
+type Job struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"`
+	Error      *api.Error      `json:"error,omitempty"`
+	Created    time.Time       `json:"created"`
+	Started    *time.Time      `json:"started,omitempty"`
+	Finished   *time.Time      `json:"finished,omitempty"`
+	Expires    *time.Time      `json:"expires,omitempty"`
+	DurationMS int64           `json:"duration_ms,omitempty"`
+	Result     string          `json:"result,omitempty"`
+	Object     *storage.Object `json:"object,omitempty"`
+	Callback   *Callback       `json:"callback,omitempty"`
+
+	result *Result
+}
+
+/*
+Jobs runs and stores asynchronous render jobs
+
+At most workers jobs run at once, the rest wait in the queued state, and at
+most maxQueued jobs are unfinished. Finished jobs and their results are removed
+after the ttl period. Jobs with a callback
+are delivered through the webhook when they finish.
+*/
+type Jobs struct {
+	ttl       time.Duration
+	maxQueued int
+	slots     chan struct{}
+	webhook   *Webhook
+
+	mux        sync.Mutex
+	jobs       map[string]*Job
+	unfinished int
+}
+
+/*
+NewJobs returns a pointer to a Jobs store and starts removing expired jobs
+*/
+func NewJobs(workers, maxQueued int, ttl time.Duration, webhook *Webhook) *Jobs {
+	jobs := &Jobs{
+		ttl:       ttl,
+		maxQueued: maxQueued,
+		slots:     make(chan struct{}, workers),
+		webhook:   webhook,
+		jobs:      make(map[string]*Job),
+	}
+	go jobs.expire()
+	return jobs
+}
+
+/*
+Add queues a render function as a new job and returns a copy of the job. The
+callback is optional. ErrJobsFull is returned if too many jobs are unfinished.
+*/
+func (jobs *Jobs) Add(render func(ctx context.Context) (*Result, error), callback *Callback) (Job, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); nil != err {
+		return Job{}, err
+	}
+	job := &Job{
+		ID:       hex.EncodeToString(id),
+		Status:   JobQueued,
+		Created:  time.Now(),
+		Callback: callback,
+	}
+
+	jobs.mux.Lock()
+	if jobs.unfinished >= jobs.maxQueued {
+		jobs.mux.Unlock()
+		log.Warnf("Job queue is full, %d jobs are unfinished", jobs.unfinished)
+		return Job{}, ErrJobsFull
+	}
+	jobs.unfinished++
+	jobs.jobs[job.ID] = job
+	snapshot := copyJob(job)
+	jobs.mux.Unlock()
+
+	go jobs.run(job, render)
+	return snapshot, nil
+}
+
+/*
+Get returns a copy of a job and its result, if it has finished
+*/
+func (jobs *Jobs) Get(id string) (Job, *Result, bool) {
+	jobs.mux.Lock()
+	defer jobs.mux.Unlock()
+	job, ok := jobs.jobs[id]
+	if !ok {
+		return Job{}, nil, false
+	}
+	return copyJob(job), job.result, true
+}
+
+/*
+copyJob returns a copy of a job that is safe to use without holding the lock
+*/
+func copyJob(job *Job) Job {
+	snapshot := *job
+	if nil != job.Callback {
+		callback := *job.Callback
+		callback.Deliveries = append([]Delivery{}, job.Callback.Deliveries...)
+		snapshot.Callback = &callback
+	}
+	return snapshot
+}
+
+/*
+run waits for a worker slot and runs the job. Jobs wait for a tab rather than
+fail when the tab pool is busy.
+*/
+func (jobs *Jobs) run(job *Job, render func(ctx context.Context) (*Result, error)) {
+	jobs.slots <- struct{}{}
+	defer func() { <-jobs.slots }()
+
+	started := time.Now()
+	jobs.mux.Lock()
+	job.Status = JobRunning
+	job.Started = &started
+	jobs.mux.Unlock()
+	log.Debugf("Job %s started", job.ID)
+
+	result, err := render(waitForTab(context.Background()))
+	jobs.finish(job, started, result, err)
+
+	if nil != job.Callback {
+		go jobs.notify(job)
+	}
+}
+
+/*
+finish records the outcome of a job
+*/
+func (jobs *Jobs) finish(job *Job, started time.Time, result *Result, err error) {
+	finished := time.Now()
+	expires := finished.Add(jobs.ttl)
+	jobs.mux.Lock()
+	defer jobs.mux.Unlock()
+	jobs.unfinished--
+	job.Finished = &finished
+	job.Expires = &expires
+	job.DurationMS = int64(finished.Sub(started) / time.Millisecond)
+	if nil != err {
+		log.Errorf("Job %s failed: %s", job.ID, err)
+		job.Status = JobFailed
+		job.Error = renderError(err)
+		return
+	}
+	log.Debugf("Job %s finished", job.ID)
+	job.Status = JobDone
+	job.Result = fmt.Sprintf("/jobs/%s/result", job.ID)
+	job.Object = result.Object
+	job.result = result
+}
+
+/*
+notify delivers a finished job's callback, either the job status as JSON or the
+result itself, and records each delivery attempt
+*/
+func (jobs *Jobs) notify(job *Job) {
+	jobs.mux.Lock()
+	snapshot := copyJob(job)
+	result := job.result
+	jobs.mux.Unlock()
+	callback := snapshot.Callback
+
+	contentType := "application/json"
+	var body []byte
+	if "result" == callback.Body && nil != result && nil == result.Object {
+		contentType = result.ContentType
+		body = result.Data
+	} else {
+		if "" != snapshot.Result {
+			snapshot.Result = callback.baseURL + snapshot.Result
+		}
+		snapshot.Callback = nil
+		body, _ = json.Marshal(snapshot)
+	}
+
+	delivered := jobs.webhook.Deliver(job.ID, callback.URL, contentType, body, func(delivery Delivery) {
+		jobs.mux.Lock()
+		defer jobs.mux.Unlock()
+		job.Callback.Deliveries = append(job.Callback.Deliveries, delivery)
+	})
+
+	jobs.mux.Lock()
+	defer jobs.mux.Unlock()
+	if delivered {
+		job.Callback.Status = CallbackDelivered
+	} else {
+		job.Callback.Status = CallbackFailed
+	}
+}
+
+/*
+expire periodically removes finished jobs whose ttl has passed
+*/
+func (jobs *Jobs) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		jobs.mux.Lock()
+		for id, job := range jobs.jobs {
+			if nil != job.Expires && now.After(*job.Expires) {
+				log.Debugf("Job %s expired", id)
+				delete(jobs.jobs, id)
+			}
+		}
+		jobs.mux.Unlock()
+	}
+}
+
+/*
+CreateJob queues an asynchronous render job and returns its status
+
+The job is described by the same parameters as the render endpoints, as query
+parameters or JSON properties. A JSON 'html' property renders HTML content,
+otherwise the 'url' parameters are rendered.
+
+If a 'callback_url' parameter is given the job is posted to it when it
+finishes. 'callback_body' selects whether the job 'status' (default) or the
+'result' itself is posted.
+*/
+func (htmltox *HTMLToX) CreateJob(response http.ResponseWriter, request *http.Request) {
+	var render func(ctx context.Context) (*Result, error)
+
+	params, html, err := htmltox.readParams(request)
+	var options *RenderOptions
+	if nil == err {
+		options, err = DecodeOptions(params)
+	}
+	if nil == err && "" != html {
+		err = validateContentOptions(options)
+	}
+	if nil == err {
+		err = htmltox.validateOptions(options)
+	}
+	var callback *Callback
+	if nil == err {
+		callback, err = htmltox.getCallback(request, params)
+	}
+	if nil == err {
+		err = htmltox.checkStore(options)
+	}
+	if nil == err {
+		switch {
+		case "" != html:
+			render = func(ctx context.Context) (*Result, error) {
+				return htmltox.Render(ctx, options, Source{HTML: html})
+			}
+		case 0 == len(options.URLs):
+			err = api.InvalidParam("url", "Either the 'url' param or HTML content is required")
+		case len(options.URLs) > 1 || "" != options.Output:
+			render = func(ctx context.Context) (*Result, error) {
+				return batchResult(htmltox.RenderBatch(ctx, options, options.URLs), options)
+			}
+		default:
+			render = func(ctx context.Context) (*Result, error) {
+				return htmltox.Render(ctx, options, Source{URL: options.URLs[0]})
+			}
+		}
+	}
+	if nil != err {
+		htmltox.API.RespondWithError(request, response, err)
+		return
+	}
+
+	job, err := htmltox.Jobs.Add(func(ctx context.Context) (*Result, error) {
+		result, err := render(ctx)
+		if nil != err {
+			return nil, err
+		}
+		return htmltox.store(result, options)
+	}, callback)
+	if nil != err {
+		htmltox.API.RespondWithError(request, response, renderError(err))
+		return
+	}
+
+	headers := make(map[string]string)
+	headers["Location"] = fmt.Sprintf("/jobs/%s", job.ID)
+	htmltox.API.RespondWithJSONBody(
+		request,
+		response,
+		202,
+		job,
+		headers,
+	)
+}
+
+/*
+getCallback validates the callback parameters and returns the job callback, or
+nil if there is no 'callback_url' parameter
+*/
+func (htmltox *HTMLToX) getCallback(request *http.Request, params url.Values) (*Callback, error) {
+	if 0 == len(params["callback_url"]) {
+		if 0 < len(params["callback_body"]) {
+			return nil, api.InvalidParam("callback_body", "The 'callback_body' param requires a 'callback_url'")
+		}
+		return nil, nil
+	}
+
+	if 0 == len(htmltox.Webhook.secret) {
+		return nil, api.InvalidParam("callback_url", "Callbacks are not available, WEBHOOK_SECRET is not configured")
+	} else if len(params["callback_url"]) > 1 {
+		return nil, api.InvalidParam("callback_url", "Only one 'callback_url' parameter is allowed")
+	} else if len(params["callback_body"]) > 1 {
+		return nil, api.InvalidParam("callback_body", "Only one 'callback_body' parameter is allowed")
+	}
+
+	callbackURL, err := url.ParseRequestURI(params["callback_url"][0])
+	if nil != err || ("http" != callbackURL.Scheme && "https" != callbackURL.Scheme) || "" == callbackURL.Host {
+		return nil, api.InvalidParam("callback_url", "Invalid callback_url '%s'", params["callback_url"][0])
+	}
+
+	body := "status"
+	if 0 < len(params["callback_body"]) {
+		body = params["callback_body"][0]
+	}
+	if "status" != body && "result" != body {
+		return nil, api.InvalidParam("callback_body", "Invalid callback_body '%s', must be either 'status' or 'result'", body)
+	}
+
+	scheme := "http"
+	if nil != request.TLS {
+		scheme = "https"
+	}
+	if proto := request.Header.Get("X-Forwarded-Proto"); "" != proto {
+		scheme = proto
+	}
+
+	return &Callback{
+		URL:        callbackURL.String(),
+		Body:       body,
+		Status:     CallbackPending,
+		Deliveries: []Delivery{},
+		baseURL:    fmt.Sprintf("%s://%s", scheme, request.Host),
+	}, nil
+}
+
+/*
+GetJob returns the status of a job
+*/
+func (htmltox *HTMLToX) GetJob(response http.ResponseWriter, request *http.Request) {
+	id := api.Vars(request)["id"]
+	job, _, ok := htmltox.Jobs.Get(id)
+	if !ok {
+		htmltox.API.RespondWithError(request, response, api.NewError(404, api.CodeNotFound, "Job '%s' not found", id))
+		return
+	}
+
+	htmltox.API.RespondWithJSONBody(
+		request,
+		response,
+		200,
+		job,
+		make(map[string]string),
+	)
+}
+
+/*
+GetJobResult returns the output of a finished job
+*/
+func (htmltox *HTMLToX) GetJobResult(response http.ResponseWriter, request *http.Request) {
+	id := api.Vars(request)["id"]
+	job, result, ok := htmltox.Jobs.Get(id)
+	if !ok {
+		htmltox.API.RespondWithError(request, response, api.NewError(404, api.CodeNotFound, "Job '%s' not found", id))
+		return
+	}
+
+	switch job.Status {
+	case JobFailed:
+		htmltox.API.RespondWithError(request, response, job.Error)
+		return
+	case JobQueued, JobRunning:
+		err := api.NewError(409, api.CodeNotReady, "Job '%s' is %s", id, job.Status)
+		err.Headers = map[string]string{"Retry-After": "1"}
+		htmltox.API.RespondWithError(request, response, err)
+		return
+	}
+
+	// Stored results are downloaded from the storage backend
+	data, contentType := result.Data, result.ContentType
+	if nil != result.Object && "" != result.Object.URL {
+		htmltox.API.RespondWithRawBody(
+			request,
+			response,
+			303,
+			"",
+			map[string]string{"Location": result.Object.URL},
+		)
+		return
+	} else if nil != result.Object {
+		var err error
+		data, contentType, err = htmltox.Storage.Get(result.Object.Key)
+		if storage.ErrNotFound == err {
+			err = api.NewError(410, api.CodeNotFound, "The result of job '%s' is no longer stored", id)
+		}
+		if nil != err {
+			htmltox.API.RespondWithError(request, response, err)
+			return
+		}
+	}
+
+	headers := make(map[string]string)
+	headers["Content-Type"] = contentType
+	headers["ETag"] = api.ETag(data)
+	if "application/zip" == contentType {
+		headers["Content-Disposition"] = fmt.Sprintf(`attachment; filename="%s.zip"`, id)
+	}
+	htmltox.API.RespondWithRawBody(
+		request,
+		response,
+		result.status(),
+		string(data),
+		headers,
+	)
+}
@@ -0,0 +1,314 @@
+package htmltox
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+	"github.com/mkenney/go-chrome/cdtp/network"
+	"github.com/mkenney/go-chrome/socket"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+secretMask replaces secret parameter values in the logs
+*/
+const secretMask = "********"
+
+/*
+Cookie is a cookie set in the browser before the page is loaded. Cookies
+without a domain are set for the target URL.
+*/
+type Cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Domain   string `json:"domain,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	SameSite string `json:"sameSite,omitempty"`
+	Expires  int64  `json:"expires,omitempty"`
+}
+
+/*
+decodeParam decodes a 'cookie' parameter, either a 'name=value' string or a
+JSON object
+*/
+func (cookie *Cookie) decodeParam(name, value string) error {
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cookie); nil != err {
+			return api.InvalidParam(name, "Invalid cookie, must be an object with 'name', 'value', 'domain', 'path', 'secure', 'httpOnly', 'sameSite' and 'expires' properties")
+		}
+	} else if parts := strings.SplitN(value, "=", 2); 2 == len(parts) {
+		cookie.Name = strings.TrimSpace(parts[0])
+		cookie.Value = strings.TrimSpace(parts[1])
+	} else {
+		return api.InvalidParam(name, "Invalid cookie, must be in the form 'name=value'")
+	}
+	return nil
+}
+
+/*
+validateNetworkOptions validates the 'header', 'cookie', 'username' and
+'password' options
+
+Headers are either 'Name: value' strings or a JSON object of names and values,
+and are normalized to 'Name: value'.
+*/
+func validateNetworkOptions(options *RenderOptions) error {
+	headers := []string{}
+	for _, value := range options.Headers {
+		if !strings.HasPrefix(strings.TrimSpace(value), "{") {
+			headers = append(headers, value)
+			continue
+		}
+		fields := make(map[string]string)
+		if err := json.Unmarshal([]byte(value), &fields); nil != err {
+			return api.InvalidParam("header", "Invalid header, must be an object of header names and string values")
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			headers = append(headers, name+": "+fields[name])
+		}
+	}
+	for a, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if 2 != len(parts) || !validHeaderName(name) {
+			return api.InvalidParam("header", "Invalid header '%s', must be in the form 'Name: value'", name)
+		} else if strings.ContainsAny(parts[1], "\r\n") {
+			return api.InvalidParam("header", "Invalid header '%s', the value may not contain line breaks", name)
+		}
+		headers[a] = name + ": " + strings.TrimSpace(parts[1])
+	}
+	options.Headers = headers
+
+	for _, cookie := range options.Cookies {
+		if "" == cookie.Name || strings.ContainsAny(cookie.Name, "=;, \t\r\n") {
+			return api.InvalidParam("cookie", "Invalid cookie name '%s'", cookie.Name)
+		} else if strings.ContainsAny(cookie.Value, ";\r\n") {
+			return api.InvalidParam("cookie", "Invalid cookie '%s', the value may not contain ';' or line breaks", cookie.Name)
+		} else if "" != cookie.SameSite && "Strict" != cookie.SameSite && "Lax" != cookie.SameSite {
+			return api.InvalidParam("cookie", "Invalid cookie '%s', 'sameSite' must be either 'Strict' or 'Lax'", cookie.Name)
+		}
+	}
+
+	if strings.Contains(options.Username, ":") {
+		return api.InvalidParam("username", "The 'username' param may not contain ':'")
+	} else if "" == options.Username && "" != options.Password {
+		return api.InvalidParam("password", "The 'password' param requires a 'username'")
+	}
+
+	return nil
+}
+
+/*
+validateContentOptions returns an error if the options do not apply to HTML
+content. HTML content is written into a blank document, so there are no URLs to
+render, no server to send credentials to and cookies need an explicit domain.
+*/
+func validateContentOptions(options *RenderOptions) error {
+	if 0 < len(options.URLs) {
+		return api.InvalidParam("url", "The 'url' param does not apply to HTML content")
+	} else if "" != options.Output {
+		return api.InvalidParam("output", "The 'output' param does not apply to HTML content")
+	} else if "" != options.Username {
+		return api.InvalidParam("username", "The 'username' and 'password' params do not apply to HTML content")
+	}
+	for _, cookie := range options.Cookies {
+		if "" == cookie.Domain {
+			return api.InvalidParam("cookie", "Invalid cookie '%s', a 'domain' is required for HTML content", cookie.Name)
+		}
+	}
+	return nil
+}
+
+/*
+validHeaderName returns true if name is a valid HTTP header name
+*/
+func validHeaderName(name string) bool {
+	if "" == name {
+		return false
+	}
+	for _, char := range name {
+		switch {
+		case 'a' <= char && char <= 'z', 'A' <= char && char <= 'Z', '0' <= char && char <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", char):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+/*
+cookieParams returns the 'cookie' options as browser cookies. Cookies without
+a domain are set for target.
+*/
+func cookieParams(options *RenderOptions, target string) []*network.CookieParam {
+	cookies := []*network.CookieParam{}
+	for _, cookie := range options.Cookies {
+		param := &network.CookieParam{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Domain:   cookie.Domain,
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HTTPOnly: cookie.HTTPOnly,
+			SameSite: cookie.SameSite,
+			Expires:  network.TimeSinceEpoch(cookie.Expires),
+		}
+		if "" == param.Domain {
+			param.URL = target
+		}
+		cookies = append(cookies, param)
+	}
+	return cookies
+}
+
+/*
+setNetwork sets the extra request headers and the cookies before the page is
+loaded. They are removed again when the tab is released, along with the cookies
+the target set during a job with credentials.
+*/
+func setNetwork(ctx context.Context, tab *Tab, options *RenderOptions, target string) error {
+	if hasCredentials(options) {
+		tab.authURL = target
+	}
+	if 0 == len(options.Headers) && 0 == len(options.Cookies) {
+		return nil
+	}
+
+	var enableResult *network.EnableResult
+	if err := await(ctx, tab.Network().Enable(&network.EnableParams{}), &enableResult); nil != err {
+		return err
+	}
+	if nil != enableResult.CDTPError {
+		log.Errorf("Network.Enable: %s", enableResult.CDTPError.Error())
+		return enableResult.CDTPError
+	}
+
+	if len(options.Headers) > 0 {
+		headers := network.Headers{}
+		for _, header := range options.Headers {
+			parts := strings.SplitN(header, ": ", 2)
+			if value, ok := headers[parts[0]]; ok {
+				headers[parts[0]] = value.(string) + ", " + parts[1]
+			} else {
+				headers[parts[0]] = parts[1]
+			}
+		}
+		tab.headers = true
+		var headersResult *network.SetExtraHTTPHeadersResult
+		if err := await(ctx, tab.Network().SetExtraHTTPHeaders(&network.SetExtraHTTPHeadersParams{
+			Headers: headers,
+		}), &headersResult); nil != err {
+			return err
+		}
+		if nil != headersResult.CDTPError {
+			log.Errorf("Network.setExtraHTTPHeaders: %s", headersResult.CDTPError.Error())
+			return headersResult.CDTPError
+		}
+	}
+
+	if len(options.Cookies) > 0 {
+		tab.cookies = cookieParams(options, target)
+		var cookiesResult *network.SetCookiesResult
+		if err := await(ctx, tab.Network().SetCookies(&network.SetCookiesParams{
+			Cookies: tab.cookies,
+		}), &cookiesResult); nil != err {
+			return err
+		}
+		if nil != cookiesResult.CDTPError {
+			log.Errorf("Network.setCookies: %s", cookiesResult.CDTPError.Error())
+			return cookiesResult.CDTPError
+		}
+	}
+
+	return nil
+}
+
+/*
+setAuth sends the 'username' and 'password' options as a basic Authorization
+header with the requests to the target's origin. Only those requests are
+intercepted, requests to other origins never carry the credentials. Answering
+challenges instead would leave the credentials in the browser's HTTP auth
+cache, where later jobs would use them.
+*/
+func setAuth(ctx context.Context, tab *Tab, options *RenderOptions, target string) error {
+	if "" == options.Username {
+		return nil
+	}
+	parsed, err := url.Parse(target)
+	if nil != err {
+		return err
+	}
+	origin := parsed.Scheme + "://" + parsed.Host
+	if port := parsed.Port(); ("http" == parsed.Scheme && "80" == port) || ("https" == parsed.Scheme && "443" == port) {
+		origin = parsed.Scheme + "://" + parsed.Hostname()
+	}
+	authorization := "Basic " + base64.StdEncoding.EncodeToString([]byte(options.Username+":"+options.Password))
+
+	tab.AddEventHandler(socket.NewEventHandler("Network.requestIntercepted", func(response *socket.Response) {
+		event := struct {
+			InterceptionID network.InterceptionID `json:"interceptionId"`
+			Request        struct {
+				Headers network.Headers `json:"headers"`
+			} `json:"request"`
+		}{}
+		if err := json.Unmarshal(response.Params, &event); nil != err {
+			log.Debugf("Failed to decode intercepted request: %s", err)
+			return
+		}
+		headers := network.Headers{}
+		for name, value := range event.Request.Headers {
+			if "authorization" != strings.ToLower(name) {
+				headers[name] = value
+			}
+		}
+		headers["Authorization"] = authorization
+
+		// Event handlers can't wait for command results
+		go func() {
+			var continueResult *network.ContinueInterceptedRequestResult
+			if err := await(ctx, tab.Network().ContinueInterceptedRequest(&network.ContinueInterceptedRequestParams{
+				InterceptionID: event.InterceptionID,
+				Headers:        headers,
+			}), &continueResult); nil == err && nil != continueResult.CDTPError {
+				log.Debugf("Network.continueInterceptedRequest: %s", continueResult.CDTPError.Error())
+			}
+		}()
+	}))
+
+	var enableResult *network.EnableResult
+	if err := await(ctx, tab.Network().Enable(&network.EnableParams{}), &enableResult); nil != err {
+		return err
+	} else if nil != enableResult.CDTPError {
+		log.Errorf("Network.Enable: %s", enableResult.CDTPError.Error())
+		return enableResult.CDTPError
+	}
+
+	tab.intercept = true
+	var interceptResult *network.SetRequestInterceptionResult
+	if err := await(ctx, tab.Network().SetRequestInterception(&network.SetRequestInterceptionParams{
+		Patterns: []*network.RequestPattern{{URLPattern: origin + "/*"}},
+	}), &interceptResult); nil != err {
+		return err
+	} else if nil != interceptResult.CDTPError {
+		log.Errorf("Network.setRequestInterception: %s", interceptResult.CDTPError.Error())
+		return interceptResult.CDTPError
+	}
+	return nil
+}
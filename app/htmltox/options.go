@@ -0,0 +1,444 @@
+package htmltox
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+	"github.com/mkenney/docker-htmltox/app/config"
+)
+
+/*
+RenderOptions describes a render. It is the single schema of the render
+parameters: the 'param' tags are the query parameter, form field and JSON
+property names, and the 'doc' tags are served by the /options endpoint.
+
+Zero values are unset and Validate replaces them with their defaults, so
+options built in code only need the fields they change:
+
+	options := &htmltox.RenderOptions{Format: "pdf", URLs: []string{"https://example.com"}}
+	if err := options.Validate(cfg.Render); nil != err {
+		...
+	}
+	result, err := service.Render(ctx, options, htmltox.Source{URL: options.URLs[0]})
+*/
+type RenderOptions struct {
+	// Output
+	Format   string `param:"format" json:"format,omitempty" doc:"The output format, 'png', 'jpeg', 'webp' or 'pdf'. 'jpg' is accepted for 'jpeg'. Default 'png'"`
+	Quality  int    `param:"quality" json:"quality,omitempty" doc:"The 'jpeg' and 'webp' image quality, 1 - 100. Default 100 for 'jpeg'"`
+	MaxBytes int    `param:"max-bytes" json:"max-bytes,omitempty" doc:"The maximum size of a 'jpeg' or 'webp' image. Images are encoded again at lower qualities, down to 10, until they fit"`
+	Output   string `param:"output" json:"output,omitempty" doc:"The batch response format, 'json' or 'zip'. Default 'json' when several 'url' parameters are given. The status is 207 if only some renders succeed"`
+	Store    bool   `param:"store" json:"store,omitempty" doc:"Write the output to the storage backend and return its key and URL instead"`
+	NoCache  bool   `param:"nocache" json:"nocache,omitempty" doc:"Bypass the render cache"`
+	Timeout  int    `param:"timeout" json:"timeout,omitempty" doc:"Seconds to wait for the wait conditions before rendering anyway. Default render.timeout"`
+
+	// Source
+	URLs []string `param:"url" json:"url,omitempty" doc:"The URLs to render. Several URLs are rendered as a batch, up to render.max_batch_size"`
+
+	// Viewport
+	Device string  `param:"device" json:"device,omitempty" doc:"A device preset: 'desktop', 'desktop-hd', 'desktop-retina', 'ipad', 'ipad-pro', 'iphone', 'iphone-se' or 'pixel', rotated by adding '-landscape' to the name"`
+	Width  int     `param:"width" json:"width,omitempty" doc:"The viewport width in CSS pixels. Default the device width, or 1440"`
+	Height int     `param:"height" json:"height,omitempty" doc:"The viewport height in CSS pixels. Default the device height, or 1440"`
+	Scale  float64 `param:"scale" json:"scale,omitempty" doc:"The device scale factor of images, a positive integer, or the print scale of PDF documents, 0.1 - 2. Default the device scale factor, or 1"`
+
+	// Capture area
+	FullPage bool   `param:"fullpage" json:"fullpage,omitempty" doc:"Capture the full height of the document instead of the viewport"`
+	Selector string `param:"selector" json:"selector,omitempty" doc:"Capture the first element matching this CSS selector"`
+	Padding  int    `param:"padding" json:"padding,omitempty" doc:"Pixels added around the 'selector' element"`
+	XOffset  int    `param:"x-offset" json:"x-offset,omitempty" doc:"The left edge of the capture in CSS pixels"`
+	YOffset  int    `param:"y-offset" json:"y-offset,omitempty" doc:"The top edge of the capture in CSS pixels"`
+
+	// Image processing
+	Crop        Crop `param:"crop" json:"crop,omitempty" doc:"The 'x,y,width,height' rectangle of the capture to keep, in image pixels"`
+	ResizeWidth int  `param:"resize-width" json:"resize-width,omitempty" doc:"The width to scale the image down to, keeping its aspect ratio. Images are never enlarged"`
+	Grayscale   bool `param:"grayscale" json:"grayscale,omitempty" doc:"Convert the image to grayscale"`
+
+	// PDF documents
+	Paper             string   `param:"paper" json:"paper,omitempty" doc:"The paper size: 'letter', 'legal', 'tabloid', 'ledger' or 'a0' - 'a6'. Default 'letter'"`
+	PaperWidth        float64  `param:"paper-width" json:"paper-width,omitempty" doc:"The paper width in inches. Default the width of the paper size"`
+	PaperHeight       float64  `param:"paper-height" json:"paper-height,omitempty" doc:"The paper height in inches. Default the height of the paper size"`
+	MarginTop         *float64 `param:"margin-top" json:"margin-top,omitempty" doc:"The top margin in inches. Default 0.4"`
+	MarginBottom      *float64 `param:"margin-bottom" json:"margin-bottom,omitempty" doc:"The bottom margin in inches. Default 0.4"`
+	MarginLeft        *float64 `param:"margin-left" json:"margin-left,omitempty" doc:"The left margin in inches. Default 0.4"`
+	MarginRight       *float64 `param:"margin-right" json:"margin-right,omitempty" doc:"The right margin in inches. Default 0.4"`
+	Landscape         bool     `param:"landscape" json:"landscape,omitempty" doc:"Print in landscape orientation"`
+	Orientation       string   `param:"orientation" json:"orientation,omitempty" doc:"The paper orientation, 'portrait' or 'landscape'. An alternative to 'landscape'"`
+	HeaderTemplate    string   `param:"header-template" json:"header-template,omitempty" doc:"An HTML template for the print header. Elements with the classes 'date', 'title', 'url', 'pageNumber' and 'totalPages' are populated"`
+	FooterTemplate    string   `param:"footer-template" json:"footer-template,omitempty" doc:"An HTML template for the print footer, like 'header-template'"`
+	PageRanges        string   `param:"page-ranges" json:"page-ranges,omitempty" doc:"The pages to print, e.g. '1-5, 8, 11-' where an open range runs to the last page. Default all pages"`
+	PrintBackground   bool     `param:"print-background" json:"print-background,omitempty" doc:"Print background graphics"`
+	PreferCSSPageSize bool     `param:"prefer-css-page-size" json:"prefer-css-page-size,omitempty" doc:"Use the page size defined by the CSS @page rule"`
+
+	// Wait conditions
+	Wait           []string `param:"wait" json:"wait,omitempty" doc:"The page events to wait for: 'load', 'domcontentloaded', 'networkidle' and 'fonts', repeated or comma separated. Default 'load'"`
+	WaitSelector   string   `param:"wait-selector" json:"wait-selector,omitempty" doc:"Wait for a CSS selector to match an element"`
+	WaitExpression string   `param:"wait-expression" json:"wait-expression,omitempty" doc:"Wait for a JavaScript expression to be truthy. Exceptions count as false, the last one is reported if the expression is still false at the timeout"`
+	WaitDelay      int      `param:"wait-delay" json:"wait-delay,omitempty" doc:"Milliseconds to wait after the other conditions are met"`
+	IdleTime       int      `param:"idle-time" json:"idle-time,omitempty" doc:"Milliseconds without network requests before the network is idle. Default 500"`
+
+	// Page content
+	CSS          string `param:"css" json:"css,omitempty" doc:"A stylesheet added to the page after it loads"`
+	Media        string `param:"media" json:"media,omitempty" doc:"The CSS media type to emulate, 'screen' or 'print'"`
+	ScriptBefore string `param:"script_before" json:"script_before,omitempty" doc:"JavaScript that runs before any script of the page"`
+	ScriptAfter  string `param:"script_after" json:"script_after,omitempty" doc:"JavaScript that runs after the wait conditions are met. If it completes with a promise the capture waits for it"`
+
+	// Requests
+	Headers  []string `param:"header" json:"header,omitempty" doc:"Extra request headers, 'Name: value' or a JSON object of names and values"`
+	Cookies  []Cookie `param:"cookie" json:"cookie,omitempty" doc:"Cookies set before the page loads, 'name=value' or JSON objects with 'name', 'value', 'domain', 'path', 'secure', 'httpOnly', 'sameSite' and 'expires' properties"`
+	Username string   `param:"username" json:"username,omitempty" doc:"The HTTP basic authentication username for URLs"`
+	Password string   `param:"password" json:"password,omitempty" doc:"The HTTP basic authentication password for URLs"`
+}
+
+/*
+OptionDoc documents a render parameter
+*/
+type OptionDoc struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Repeatable  bool   `json:"repeatable,omitempty"`
+	Description string `json:"description"`
+}
+
+/*
+paramDecoder is implemented by option types that decode themselves from a
+parameter value
+*/
+type paramDecoder interface {
+	decodeParam(name, value string) error
+}
+
+/*
+DecodeOptions returns the render options described by a set of parameters.
+Unknown parameters are ignored. The options are not validated.
+*/
+func DecodeOptions(params url.Values) (*RenderOptions, error) {
+	options := &RenderOptions{}
+	fields := reflect.ValueOf(options).Elem()
+	for a := 0; a < fields.NumField(); a++ {
+		name := fields.Type().Field(a).Tag.Get("param")
+		if 0 == len(params[name]) {
+			continue
+		}
+		if err := decodeField(fields.Field(a), name, params[name]); nil != err {
+			return nil, err
+		}
+	}
+	return options, nil
+}
+
+/*
+decodeField decodes the values of a parameter into an option field. Only slice
+fields may have more than one value.
+*/
+func decodeField(field reflect.Value, name string, values []string) error {
+	if reflect.Slice != field.Kind() {
+		if len(values) > 1 {
+			return api.InvalidParam(name, "Only one '%s' parameter is allowed", name)
+		}
+		return decodeValue(field, name, values[0])
+	}
+
+	slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+	for a, value := range values {
+		if err := decodeValue(slice.Index(a), name, value); nil != err {
+			return err
+		}
+	}
+	field.Set(slice)
+	return nil
+}
+
+/*
+decodeValue decodes a parameter value into an option field
+*/
+func decodeValue(field reflect.Value, name, value string) error {
+	if reflect.Ptr == field.Kind() {
+		field.Set(reflect.New(field.Type().Elem()))
+		field = field.Elem()
+	}
+	if decoder, ok := field.Addr().Interface().(paramDecoder); ok {
+		return decoder.decodeParam(name, value)
+	}
+
+	var err error
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		// An empty flag is unset
+		var flag bool
+		if "" != value {
+			flag, err = strconv.ParseBool(value)
+		}
+		field.SetBool(flag)
+	case reflect.Int:
+		var num int
+		num, err = strconv.Atoi(strings.TrimSpace(value))
+		field.SetInt(int64(num))
+	case reflect.Float64:
+		var num float64
+		num, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if nil == err && (math.IsNaN(num) || math.IsInf(num, 0)) {
+			err = fmt.Errorf("%s is not a finite number", value)
+		}
+		field.SetFloat(num)
+	default:
+		err = fmt.Errorf("unsupported option type %s", field.Type())
+	}
+	if nil != err {
+		return api.InvalidParam(name, "Invalid %s '%s'", name, value)
+	}
+	return nil
+}
+
+/*
+OptionsSchema returns the documentation of the render parameters, in the order
+they are declared
+*/
+func OptionsSchema() []OptionDoc {
+	optionsType := reflect.TypeOf(RenderOptions{})
+	docs := make([]OptionDoc, 0, optionsType.NumField())
+	for a := 0; a < optionsType.NumField(); a++ {
+		field := optionsType.Field(a)
+		fieldType := field.Type
+		if reflect.Ptr == fieldType.Kind() {
+			fieldType = fieldType.Elem()
+		}
+		doc := OptionDoc{
+			Name:        field.Tag.Get("param"),
+			Description: field.Tag.Get("doc"),
+		}
+		if reflect.Slice == fieldType.Kind() {
+			doc.Repeatable = true
+			fieldType = fieldType.Elem()
+		}
+		doc.Type = optionType(fieldType)
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+/*
+optionType returns the documented type of an option value
+*/
+func optionType(valueType reflect.Type) string {
+	switch valueType {
+	case reflect.TypeOf(Cookie{}):
+		return "cookie"
+	case reflect.TypeOf(Crop{}):
+		return "rectangle"
+	}
+	switch valueType.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int:
+		return "integer"
+	case reflect.Float64:
+		return "number"
+	}
+	return "string"
+}
+
+/*
+knownParam returns true if name is a render parameter
+*/
+func knownParam(name string) bool {
+	optionsType := reflect.TypeOf(RenderOptions{})
+	for a := 0; a < optionsType.NumField(); a++ {
+		if name == optionsType.Field(a).Tag.Get("param") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Validate checks the options and populates the defaults of unset options. limits
+provides the default timeout and the batch size limit.
+*/
+func (options *RenderOptions) Validate(limits config.Render) error {
+	// format
+	// Must be "png", "jpeg", "webp" or "pdf". Default "png"
+	switch options.Format {
+	case "":
+		options.Format = "png"
+	case "jpg":
+		options.Format = "jpeg"
+	case "png", "jpeg", "webp", "pdf":
+	default:
+		return api.InvalidParam("format", "Invalid format '%s', must be either 'png', 'jpeg', 'webp' or 'pdf'", options.Format)
+	}
+	pdf := "pdf" == options.Format
+	lossy := "jpeg" == options.Format || "webp" == options.Format
+
+	// fullpage
+	// Only applicable to image formats
+	if options.FullPage && pdf {
+		return api.InvalidParam("fullpage", "The 'fullpage' param does not apply to the 'pdf' format")
+	}
+
+	// width, height
+	// Must be positive integers
+	if 0 > options.Width {
+		return api.InvalidParam("width", "Invalid width '%d'", options.Width)
+	} else if 0 > options.Height {
+		return api.InvalidParam("height", "Invalid height '%d'", options.Height)
+	}
+
+	// output
+	// The batch response format, either "json" or "zip"
+	if "" != options.Output && "json" != options.Output && "zip" != options.Output {
+		return api.InvalidParam("output", "Invalid output '%s', must be either 'json' or 'zip'", options.Output)
+	}
+
+	// padding
+	// Must be a non-negative integer. Only applicable with 'selector'
+	if 0 > options.Padding {
+		return api.InvalidParam("padding", "Invalid padding '%d'", options.Padding)
+	}
+
+	// quality
+	// Only applicable to the "jpeg" and "webp" formats. Must be an integer
+	// between 1 and 100. Default 100 for "jpeg"
+	if 0 != options.Quality && !lossy {
+		return api.InvalidParam("quality", "The 'quality' param only applies to the 'jpeg' and 'webp' formats")
+	} else if 0 > options.Quality || 100 < options.Quality {
+		return api.InvalidParam("quality", "Invalid quality '%d', must be between 1 and 100", options.Quality)
+	} else if 0 == options.Quality && "jpeg" == options.Format {
+		options.Quality = 100
+	}
+
+	// max-bytes
+	// Only applicable to the "jpeg" and "webp" formats. Must be a positive
+	// integer. Images are captured at lower qualities until they fit
+	if 0 != options.MaxBytes && !lossy {
+		return api.InvalidParam("max-bytes", "The 'max-bytes' param only applies to the 'jpeg' and 'webp' formats")
+	} else if 0 > options.MaxBytes {
+		return api.InvalidParam("max-bytes", "Invalid max-bytes '%d', must be a positive integer", options.MaxBytes)
+	} else if 0 != options.MaxBytes && 0 == options.Quality {
+		options.Quality = 100
+	}
+
+	// scale
+	// Must be an integer, or a number between 0.1 and 2 for the "pdf" format.
+	// PDFs print at full size, images use the scale factor of the device
+	if pdf && 0 == options.Scale {
+		options.Scale = 1
+	} else if pdf && (0.1 > options.Scale || 2 < options.Scale) {
+		return api.InvalidParam("scale", "Invalid scale '%g', must be between 0.1 and 2", options.Scale)
+	} else if !pdf && (0 > options.Scale || options.Scale != math.Trunc(options.Scale)) {
+		return api.InvalidParam("scale", "Invalid scale '%g'", options.Scale)
+	}
+
+	// selector
+	// A CSS selector. Only applicable to image formats
+	if "" != options.Selector && pdf {
+		return api.InvalidParam("selector", "The 'selector' param does not apply to the 'pdf' format")
+	} else if "" != options.Selector && options.FullPage {
+		return api.InvalidParam("selector", "The 'selector' and 'fullpage' params may not be combined")
+	}
+
+	// timeout
+	// Must be a non-negative integer. Default render.timeout
+	if 0 > options.Timeout {
+		return api.InvalidParam("timeout", "Invalid timeout '%d'", options.Timeout)
+	} else if 0 == options.Timeout {
+		options.Timeout = limits.Timeout
+	}
+
+	// url
+	// Must be a valid URL. Up to render.max_batch_size values are allowed
+	if len(options.URLs) > limits.MaxBatchSize {
+		return api.InvalidParam("url", "Only %d 'url' parameters are allowed", limits.MaxBatchSize)
+	}
+	for k, urlParam := range options.URLs {
+		if _, err := url.ParseRequestURI(urlParam); nil != err {
+			return api.InvalidParam("url", "Invalid URL '%s'", urlParam)
+		}
+		if "/" != urlParam[len(urlParam)-1:] {
+			options.URLs[k] += "/"
+		}
+	}
+
+	// x-offset, y-offset
+	// Must be non-negative integers
+	if 0 > options.XOffset {
+		return api.InvalidParam("x-offset", "Invalid x-offset '%d'", options.XOffset)
+	} else if 0 > options.YOffset {
+		return api.InvalidParam("y-offset", "Invalid y-offset '%d'", options.YOffset)
+	}
+
+	offset := 0 != options.XOffset || 0 != options.YOffset
+	if "" == options.Selector && 0 != options.Padding {
+		return api.InvalidParam("padding", "The 'padding' param only applies to 'selector' captures")
+	} else if "" != options.Selector && offset {
+		return api.InvalidParam("x-offset", "The 'x-offset' and 'y-offset' params may not be combined with 'selector'")
+	}
+
+	// Full page captures always start at the top left corner of the document
+	if options.FullPage && offset {
+		return api.InvalidParam("x-offset", "The 'x-offset' and 'y-offset' params may not be combined with 'fullpage'")
+	}
+
+	// paper, margins, landscape, etc.
+	// Only applicable to the "pdf" format
+	if err := validatePDFOptions(options); nil != err {
+		return err
+	}
+
+	// wait, wait-selector, wait-expression, wait-delay, idle-time
+	// The conditions that must be met before rendering
+	if err := validateWaitOptions(options); nil != err {
+		return err
+	}
+
+	// crop, resize-width, grayscale
+	// Processing applied to the captured image
+	if err := validateProcessOptions(options); nil != err {
+		return err
+	}
+
+	// device
+	// A preset of the viewport, scale factor, user-agent and touch support
+	if err := validateDeviceOptions(options); nil != err {
+		return err
+	}
+
+	// css, media
+	// Styles applied to the page
+	if err := validateStyleOptions(options); nil != err {
+		return err
+	}
+
+	// header, cookie, username, password
+	// Sent with the requests the page makes
+	return validateNetworkOptions(options)
+}
+
+/*
+String returns a JSON description of the options, for logging, with the values
+of the credentials, headers and cookies masked
+*/
+func (options *RenderOptions) String() string {
+	scrubbed := *options
+	scrubbed.Headers = make([]string, len(options.Headers))
+	for a, header := range options.Headers {
+		scrubbed.Headers[a] = strings.SplitN(header, ":", 2)[0] + ": " + secretMask
+	}
+	scrubbed.Cookies = make([]Cookie, len(options.Cookies))
+	for a, cookie := range options.Cookies {
+		cookie.Value = secretMask
+		scrubbed.Cookies[a] = cookie
+	}
+	if "" != scrubbed.Password {
+		scrubbed.Password = secretMask
+	}
+
+	encoded, _ := json.Marshal(scrubbed)
+	return string(encoded)
+}
@@ -0,0 +1,200 @@
+package htmltox
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+	"github.com/mkenney/docker-htmltox/app/config"
+)
+
+/*
+testLimits are the render limits used by the tests
+*/
+var testLimits = config.Render{
+	Timeout:      30,
+	MaxBatchSize: 2,
+}
+
+/*
+TestDecodeOptions checks that parameters are decoded into the option fields
+*/
+func TestDecodeOptions(t *testing.T) {
+	options, err := DecodeOptions(url.Values{
+		"format":     {"jpeg"},
+		"quality":    {" 80 "},
+		"scale":      {"1.5"},
+		"fullpage":   {"true"},
+		"grayscale":  {""},
+		"url":        {"http://example.com", "http://example.org"},
+		"wait":       {"load", "fonts"},
+		"crop":       {"10,20,30,40"},
+		"margin-top": {"0"},
+		"unknown":    {"ignored"},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if "jpeg" != options.Format || 80 != options.Quality || 1.5 != options.Scale {
+		t.Errorf("Unexpected format, quality or scale: %s", options)
+	}
+	if !options.FullPage || options.Grayscale {
+		t.Errorf("Expected fullpage to be set and grayscale to be unset: %s", options)
+	}
+	if 2 != len(options.URLs) || "http://example.org" != options.URLs[1] {
+		t.Errorf("Unexpected urls %v", options.URLs)
+	}
+	if 2 != len(options.Wait) || "fonts" != options.Wait[1] {
+		t.Errorf("Unexpected wait %v", options.Wait)
+	}
+	if 10 != options.Crop.Min.X || 20 != options.Crop.Min.Y || 30 != options.Crop.Dx() || 40 != options.Crop.Dy() {
+		t.Errorf("Unexpected crop %v", options.Crop)
+	}
+	if nil == options.MarginTop || 0 != *options.MarginTop {
+		t.Error("Expected an explicit margin-top of 0")
+	} else if nil != options.MarginBottom {
+		t.Error("Expected margin-bottom to be unset")
+	}
+}
+
+/*
+TestDecodeOptionsErrors checks that malformed parameters are reported with
+their name
+*/
+func TestDecodeOptionsErrors(t *testing.T) {
+	tests := []struct {
+		params url.Values
+		param  string
+	}{
+		{url.Values{"width": {"wide"}}, "width"},
+		{url.Values{"width": {"800", "600"}}, "width"},
+		{url.Values{"fullpage": {"maybe"}}, "fullpage"},
+		{url.Values{"scale": {"NaN"}}, "scale"},
+		{url.Values{"margin-top": {"Inf"}}, "margin-top"},
+		{url.Values{"crop": {"1,2,3"}}, "crop"},
+		{url.Values{"crop": {"0,0,0,10"}}, "crop"},
+	}
+	for _, test := range tests {
+		_, err := DecodeOptions(test.params)
+		apiErr, ok := err.(*api.Error)
+		if !ok {
+			t.Errorf("%v: expected an API error, got %v", test.params, err)
+			continue
+		}
+		if test.param != apiErr.Param || 400 != apiErr.Status {
+			t.Errorf("%v: expected a 400 error for '%s', got %d for '%s'", test.params, test.param, apiErr.Status, apiErr.Param)
+		}
+	}
+}
+
+/*
+TestValidateDefaults checks the defaults populated by Validate
+*/
+func TestValidateDefaults(t *testing.T) {
+	options := &RenderOptions{URLs: []string{"http://example.com"}}
+	if err := options.Validate(testLimits); nil != err {
+		t.Fatal(err)
+	}
+	if "png" != options.Format || 30 != options.Timeout || 0 != options.Quality {
+		t.Errorf("Unexpected defaults: %s", options)
+	}
+	if "http://example.com/" != options.URLs[0] {
+		t.Errorf("Expected a trailing slash, got '%s'", options.URLs[0])
+	}
+
+	options = &RenderOptions{Format: "jpg", Timeout: 5}
+	if err := options.Validate(testLimits); nil != err {
+		t.Fatal(err)
+	}
+	if "jpeg" != options.Format || 100 != options.Quality || 5 != options.Timeout {
+		t.Errorf("Unexpected jpeg defaults: %s", options)
+	}
+
+	options = &RenderOptions{Format: "pdf"}
+	if err := options.Validate(testLimits); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != options.Scale {
+		t.Errorf("Expected a pdf scale of 1, got %g", options.Scale)
+	}
+}
+
+/*
+TestValidate checks that invalid and conflicting options are reported with the
+name of the param at fault
+*/
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options RenderOptions
+		param   string
+	}{
+		{"valid image", RenderOptions{Format: "webp", Quality: 50, MaxBytes: 1000, Width: 800}, ""},
+		{"valid selector", RenderOptions{Selector: "#main", Padding: 10}, ""},
+		{"valid pdf", RenderOptions{Format: "pdf", Scale: 0.5}, ""},
+		{"format", RenderOptions{Format: "gif"}, "format"},
+		{"negative width", RenderOptions{Width: -1}, "width"},
+		{"png quality", RenderOptions{Quality: 50}, "quality"},
+		{"quality range", RenderOptions{Format: "jpeg", Quality: 101}, "quality"},
+		{"png max-bytes", RenderOptions{MaxBytes: 1000}, "max-bytes"},
+		{"pdf scale", RenderOptions{Format: "pdf", Scale: 3}, "scale"},
+		{"open page ranges", RenderOptions{Format: "pdf", PageRanges: "1-2, 5-, -3"}, ""},
+		{"page ranges", RenderOptions{Format: "pdf", PageRanges: "1-2-3"}, "page-ranges"},
+		{"empty page range", RenderOptions{Format: "pdf", PageRanges: "1, -"}, "page-ranges"},
+		{"image scale", RenderOptions{Scale: 1.5}, "scale"},
+		{"pdf fullpage", RenderOptions{Format: "pdf", FullPage: true}, "fullpage"},
+		{"pdf selector", RenderOptions{Format: "pdf", Selector: "#main"}, "selector"},
+		{"fullpage selector", RenderOptions{FullPage: true, Selector: "#main"}, "selector"},
+		{"padding", RenderOptions{Padding: 10}, "padding"},
+		{"selector offset", RenderOptions{Selector: "#main", XOffset: 10}, "x-offset"},
+		{"fullpage offset", RenderOptions{FullPage: true, YOffset: 10}, "x-offset"},
+		{"output", RenderOptions{Output: "tar"}, "output"},
+		{"batch size", RenderOptions{URLs: []string{"http://a.com", "http://b.com", "http://c.com"}}, "url"},
+		{"url", RenderOptions{URLs: []string{"example.com"}}, "url"},
+		{"timeout", RenderOptions{Timeout: -1}, "timeout"},
+		{"pdf crop", RenderOptions{Format: "pdf", Grayscale: true}, "crop"},
+	}
+	for _, test := range tests {
+		options := test.options
+		err := options.Validate(testLimits)
+		if "" == test.param {
+			if nil != err {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			}
+			continue
+		}
+		apiErr, ok := err.(*api.Error)
+		if !ok {
+			t.Errorf("%s: expected an API error, got %v", test.name, err)
+			continue
+		}
+		if test.param != apiErr.Param || api.CodeInvalidParam != apiErr.Code {
+			t.Errorf("%s: expected an error for '%s', got '%s': %s", test.name, test.param, apiErr.Param, apiErr.Message)
+		}
+	}
+}
+
+/*
+TestOptionsSchema checks that every option is documented once
+*/
+func TestOptionsSchema(t *testing.T) {
+	names := map[string]bool{}
+	for _, doc := range OptionsSchema() {
+		if "" == doc.Name || "" == doc.Description {
+			t.Errorf("Option '%s' is not documented", doc.Name)
+		}
+		if names[doc.Name] {
+			t.Errorf("Option '%s' is declared more than once", doc.Name)
+		}
+		names[doc.Name] = true
+		if !knownParam(doc.Name) {
+			t.Errorf("Option '%s' is not a known param", doc.Name)
+		}
+	}
+	for _, name := range []string{"format", "url", "crop", "header", "cookie", "wait"} {
+		if !names[name] {
+			t.Errorf("Option '%s' is missing", name)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package htmltox
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+	chrome "github.com/mkenney/go-chrome"
+	"github.com/mkenney/go-chrome/cdtp/page"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+paperSizes maps the named paper sizes accepted by the 'paper' parameter to their
+portrait width and height in inches
+*/
+var paperSizes = map[string][2]float64{
+	"letter":  {8.5, 11},
+	"legal":   {8.5, 14},
+	"tabloid": {11, 17},
+	"ledger":  {17, 11},
+	"a0":      {33.1, 46.8},
+	"a1":      {23.4, 33.1},
+	"a2":      {16.54, 23.4},
+	"a3":      {11.7, 16.54},
+	"a4":      {8.27, 11.7},
+	"a5":      {5.83, 8.27},
+	"a6":      {4.13, 5.83},
+}
+
+/*
+defaultMargin is the PDF page margin in inches
+*/
+const defaultMargin = 0.4
+
+/*
+validatePDFOptions validates the PDF specific options and populates their
+defaults
+*/
+func validatePDFOptions(options *RenderOptions) error {
+	if "pdf" != options.Format {
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"footer-template", "" != options.FooterTemplate},
+			{"header-template", "" != options.HeaderTemplate},
+			{"landscape", options.Landscape},
+			{"margin-bottom", nil != options.MarginBottom},
+			{"margin-left", nil != options.MarginLeft},
+			{"margin-right", nil != options.MarginRight},
+			{"margin-top", nil != options.MarginTop},
+			{"orientation", "" != options.Orientation},
+			{"page-ranges", "" != options.PageRanges},
+			{"paper", "" != options.Paper},
+			{"paper-height", 0 != options.PaperHeight},
+			{"paper-width", 0 != options.PaperWidth},
+			{"prefer-css-page-size", options.PreferCSSPageSize},
+			{"print-background", options.PrintBackground},
+		} {
+			if option.set {
+				return api.InvalidParam(option.name, "The '%s' param only applies to the 'pdf' format", option.name)
+			}
+		}
+		return nil
+	}
+
+	// paper
+	// Must be one of the named paper sizes. Default "letter"
+	options.Paper = strings.ToLower(options.Paper)
+	if "" == options.Paper {
+		options.Paper = "letter"
+	} else if _, ok := paperSizes[options.Paper]; !ok {
+		return api.InvalidParam("paper", "Invalid paper '%s'", options.Paper)
+	}
+
+	// paper-width, paper-height
+	// Must be a positive number of inches. Default the selected paper size
+	size := paperSizes[options.Paper]
+	if 0 > options.PaperWidth {
+		return api.InvalidParam("paper-width", "Invalid paper-width '%g'", options.PaperWidth)
+	} else if 0 == options.PaperWidth {
+		options.PaperWidth = size[0]
+	}
+	if 0 > options.PaperHeight {
+		return api.InvalidParam("paper-height", "Invalid paper-height '%g'", options.PaperHeight)
+	} else if 0 == options.PaperHeight {
+		options.PaperHeight = size[1]
+	}
+
+	// margin-*
+	// Must be a non-negative number of inches. Default 0.4 inches
+	for name, margin := range map[string]**float64{
+		"margin-top":    &options.MarginTop,
+		"margin-bottom": &options.MarginBottom,
+		"margin-left":   &options.MarginLeft,
+		"margin-right":  &options.MarginRight,
+	} {
+		if nil == *margin {
+			value := defaultMargin
+			*margin = &value
+		} else if 0 > **margin {
+			return api.InvalidParam(name, "Invalid %s '%g'", name, **margin)
+		}
+	}
+
+	// orientation
+	// Must be either "portrait" or "landscape". This is an alternative to the
+	// 'landscape' option and the two may not be combined
+	if "" != options.Orientation {
+		if options.Landscape {
+			return api.InvalidParam("orientation", "The 'orientation' and 'landscape' params may not be combined")
+		}
+		switch strings.ToLower(options.Orientation) {
+		case "portrait":
+		case "landscape":
+			options.Landscape = true
+		default:
+			return api.InvalidParam("orientation", "Invalid orientation '%s', must be either 'portrait' or 'landscape'", options.Orientation)
+		}
+	}
+
+	// page-ranges
+	// A comma separated list of pages or page ranges, e.g. "1-5, 8, 11-13".
+	// Either end of a range may be left open, e.g. "5-" or "-3".
+	if "" != options.PageRanges {
+		for _, pageRange := range strings.Split(options.PageRanges, ",") {
+			pageNums := strings.Split(strings.TrimSpace(pageRange), "-")
+			if len(pageNums) > 2 || (2 == len(pageNums) && "" == pageNums[0] && "" == pageNums[1]) {
+				return api.InvalidParam("page-ranges", "Invalid page-ranges '%s'", options.PageRanges)
+			}
+			for _, pageNum := range pageNums {
+				if 2 == len(pageNums) && "" == pageNum {
+					continue
+				}
+				if num, err := strconv.Atoi(pageNum); nil != err || 1 > num {
+					return api.InvalidParam("page-ranges", "Invalid page-ranges '%s'", options.PageRanges)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+renderPDF prints the current tab contents to a PDF document and returns the
+base64 encoded result
+*/
+func renderPDF(ctx context.Context, tab *chrome.Tab, options *RenderOptions) (string, error) {
+	pdfParams := &page.PrintToPDFParams{
+		PaperWidth:        options.PaperWidth,
+		PaperHeight:       options.PaperHeight,
+		MarginTop:         marginOption(options.MarginTop),
+		MarginBottom:      marginOption(options.MarginBottom),
+		MarginLeft:        marginOption(options.MarginLeft),
+		MarginRight:       marginOption(options.MarginRight),
+		PageRanges:        options.PageRanges,
+		Scale:             options.Scale,
+		Landscape:         options.Landscape,
+		PrintBackground:   options.PrintBackground,
+		PreferCSSPageSize: options.PreferCSSPageSize,
+	}
+
+	if "" != options.HeaderTemplate || "" != options.FooterTemplate {
+		pdfParams.DisplayHeaderFooter = true
+		pdfParams.HeaderTemplate = options.HeaderTemplate
+		pdfParams.FooterTemplate = options.FooterTemplate
+		// Chrome prints its default header or footer for an empty template
+		if "" == pdfParams.HeaderTemplate {
+			pdfParams.HeaderTemplate = "<span></span>"
+		}
+		if "" == pdfParams.FooterTemplate {
+			pdfParams.FooterTemplate = "<span></span>"
+		}
+	}
+
+	var result *page.PrintToPDFResult
+	if err := await(ctx, tab.Page().PrintToPDF(pdfParams), &result); nil != err {
+		return "", err
+	}
+	if nil != result.CDTPError {
+		log.Errorf("Page.PrintToPDF: %s", result.CDTPError.Error())
+		return "", result.CDTPError
+	}
+	log.Debugf("PDF rendered")
+	return result.Data, nil
+}
+
+/*
+marginOption returns the value of a margin option, or the default margin if it
+isn't set
+*/
+func marginOption(margin *float64) float64 {
+	if nil == margin {
+		return defaultMargin
+	}
+	return *margin
+}
@@ -0,0 +1,545 @@
+package htmltox
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	chrome "github.com/mkenney/go-chrome"
+	"github.com/mkenney/go-chrome/cdtp/emulation"
+	"github.com/mkenney/go-chrome/cdtp/network"
+	"github.com/mkenney/go-chrome/cdtp/page"
+	"github.com/mkenney/go-chrome/socket"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ErrPoolFull is returned by Pool.Acquire when every tab is busy and the request
+queue is full
+*/
+var ErrPoolFull = errors.New("Too many render requests, try again later")
+
+/*
+ErrPoolClosed is returned by Pool.Acquire after the pool has been closed
+*/
+var ErrPoolClosed = errors.New("The tab pool is closed")
+
+/*
+ErrBrowserRestarting is returned for jobs that were in progress when the browser
+stopped responding, and for new jobs while it is being relaunched. These
+requests can be retried.
+*/
+var ErrBrowserRestarting = errors.New("The browser is restarting, try again later")
+
+/*
+resetTimeout is the time allowed for resetting a released tab. Tabs that can't
+be reset in time are closed.
+*/
+const resetTimeout = 5 * time.Second
+
+/*
+poolContextKey is the type of the context keys read by the pool
+*/
+type poolContextKey int
+
+const (
+	waitForTabKey poolContextKey = iota
+)
+
+/*
+Pool manages a bounded set of reusable browser tabs
+
+At most size tabs are in use at once. Up to maxQueue additional requests wait
+for a tab to be released, any requests beyond that are rejected with
+ErrPoolFull unless their context was made by waitForTab.
+
+The pool has no browser until Reset is called. When the browser dies Fail
+discards its tabs and signals the jobs using them.
+*/
+type Pool struct {
+	size     int
+	maxQueue int
+
+	idle  chan *Tab
+	slots chan struct{}
+
+	// Failed is called when a tab can't be opened or reset, or a render
+	// fails unexpectedly, which usually means the browser connection is
+	// broken
+	Failed func()
+
+	// reset clears a released tab, it is replaced by the tests
+	reset func(tab *Tab, ctx context.Context) error
+
+	mux     sync.Mutex
+	browser chrome.Chromium
+	dead    chan struct{}
+	pending int
+	closed  bool
+}
+
+/*
+Tab is a browser tab managed by a Pool
+
+It tracks the event handlers, scripts, request headers, cookies, credentials
+and emulation added during a job so they can be removed before the tab is
+reused.
+*/
+type Tab struct {
+	*chrome.Tab
+	handlers  []socket.EventHandler
+	scripts   []page.ScriptIdentifier
+	headers   bool
+	cookies   []*network.CookieParam
+	authURL   string
+	intercept bool
+	bypassCSP bool
+	touch     bool
+	userAgent bool
+	dead      chan struct{}
+}
+
+/*
+Dead returns a channel that is closed if the browser that owns the tab dies
+*/
+func (tab *Tab) Dead() <-chan struct{} {
+	return tab.dead
+}
+
+/*
+Died returns true if the browser that owns the tab has died
+*/
+func (tab *Tab) Died() bool {
+	select {
+	case <-tab.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+AddEventHandler adds an event handler to the tab for the duration of the job
+*/
+func (tab *Tab) AddEventHandler(handler socket.EventHandler) {
+	tab.handlers = append(tab.handlers, handler)
+	tab.Tab.AddEventHandler(handler)
+}
+
+/*
+waitForTab returns a context whose Acquire calls wait for a tab even when the
+request queue is full. Jobs use it, they are already limited by their workers.
+*/
+func waitForTab(ctx context.Context) context.Context {
+	return context.WithValue(ctx, waitForTabKey, true)
+}
+
+/*
+waitsForTab returns true if the context was made by waitForTab
+*/
+func waitsForTab(ctx context.Context) bool {
+	wait, _ := ctx.Value(waitForTabKey).(bool)
+	return wait
+}
+
+/*
+NewPool returns a pointer to a Pool of up to size tabs
+*/
+func NewPool(size, maxQueue int) *Pool {
+	return &Pool{
+		size:     size,
+		maxQueue: maxQueue,
+		idle:     make(chan *Tab, size),
+		slots:    make(chan struct{}, size),
+		reset:    (*Tab).reset,
+	}
+}
+
+/*
+Size returns the maximum number of tabs in use at once
+*/
+func (pool *Pool) Size() int {
+	return pool.size
+}
+
+/*
+Acquire returns an idle tab, opening a new one if necessary. It blocks until a
+tab is available or the context is done. Every acquired tab must be returned
+with Release.
+*/
+func (pool *Pool) Acquire(ctx context.Context) (*Tab, error) {
+	pool.mux.Lock()
+	if pool.closed {
+		pool.mux.Unlock()
+		return nil, ErrPoolClosed
+	} else if nil == pool.browser {
+		pool.mux.Unlock()
+		return nil, ErrBrowserRestarting
+	} else if pool.pending >= pool.size+pool.maxQueue && !waitsForTab(ctx) {
+		pool.mux.Unlock()
+		log.Warnf("Tab pool is full, %d requests are pending", pool.pending)
+		return nil, ErrPoolFull
+	}
+	pool.pending++
+	pool.mux.Unlock()
+
+	select {
+	case pool.slots <- struct{}{}:
+	case <-ctx.Done():
+		pool.mux.Lock()
+		pool.pending--
+		pool.mux.Unlock()
+		return nil, ctx.Err()
+	}
+
+	select {
+	case tab := <-pool.idle:
+		log.Debugf("Reusing idle tab")
+		return tab, nil
+	default:
+	}
+
+	// The browser may have died while this request was queued
+	pool.mux.Lock()
+	browser, dead := pool.browser, pool.dead
+	pool.mux.Unlock()
+	if nil == browser {
+		pool.free()
+		return nil, ErrBrowserRestarting
+	}
+
+	chromeTab, err := browser.NewTab("about:blank")
+	if nil != err {
+		log.Errorf("Failed to open a new tab: %s", err)
+		pool.free()
+		pool.failed()
+		return nil, err
+	}
+	log.Debugf("Opened a new tab")
+	return &Tab{Tab: chromeTab, dead: dead}, nil
+}
+
+/*
+Release resets a tab and returns it to the pool. Tabs that can't be reset, or
+that are released after the pool is closed, are closed instead.
+*/
+func (pool *Pool) Release(tab *Tab) {
+	defer pool.free()
+
+	// Tabs in a dead browser are already gone
+	if tab.Died() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+	defer cancel()
+	if err := pool.reset(tab, ctx); nil != err {
+		log.Errorf("Failed to reset tab, closing it: %s", err)
+		closeTab(tab)
+		pool.failed()
+		return
+	}
+
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	if pool.closed || tab.dead != pool.dead {
+		closeTab(tab)
+		return
+	}
+	select {
+	case pool.idle <- tab:
+	default:
+		closeTab(tab)
+	}
+}
+
+/*
+Discard closes a tab instead of returning it to the pool. Tabs of abandoned jobs
+are discarded because the page may still be busy, closing the tab stops it.
+*/
+func (pool *Pool) Discard(tab *Tab) {
+	defer pool.free()
+	if !tab.Died() {
+		closeTab(tab)
+	}
+}
+
+/*
+Close closes all idle tabs. Tabs that are in use are closed when they are
+released.
+*/
+func (pool *Pool) Close() {
+	pool.mux.Lock()
+	pool.closed = true
+	pool.mux.Unlock()
+
+	for {
+		select {
+		case tab := <-pool.idle:
+			closeTab(tab)
+		default:
+			return
+		}
+	}
+}
+
+/*
+Reset sets the browser that new tabs are opened in
+*/
+func (pool *Pool) Reset(browser chrome.Chromium) {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	pool.browser = browser
+	pool.dead = make(chan struct{})
+}
+
+/*
+Fail discards the tabs of a browser that has died and signals the jobs using
+them. Acquire returns ErrBrowserRestarting until Reset is called.
+*/
+func (pool *Pool) Fail() {
+	pool.mux.Lock()
+	if nil != pool.browser {
+		close(pool.dead)
+		pool.browser = nil
+	}
+	pool.mux.Unlock()
+
+	for {
+		select {
+		case <-pool.idle:
+		default:
+			return
+		}
+	}
+}
+
+/*
+failed reports a broken tab
+*/
+func (pool *Pool) failed() {
+	if nil != pool.Failed {
+		pool.Failed()
+	}
+}
+
+/*
+free releases a pool slot
+*/
+func (pool *Pool) free() {
+	<-pool.slots
+	pool.mux.Lock()
+	pool.pending--
+	pool.mux.Unlock()
+}
+
+/*
+tabCommand is a browser command sent when a tab is reset
+*/
+type tabCommand struct {
+	method string
+	send   func(ctx context.Context) error
+}
+
+/*
+reset removes the job's event handlers and clears the page, emulation, request
+and credential state
+*/
+func (tab *Tab) reset(ctx context.Context) error {
+	for _, handler := range tab.handlers {
+		tab.Tab.RemoveEventHandler(handler)
+	}
+	for _, command := range tab.resetCommands() {
+		if err := command.send(ctx); nil != err {
+			log.Debugf("%s: %s", command.method, err)
+			return err
+		}
+	}
+	tab.clear()
+	return nil
+}
+
+/*
+clear forgets the state added during a job once it has been reset
+*/
+func (tab *Tab) clear() {
+	tab.handlers = nil
+	tab.scripts = nil
+	tab.headers = false
+	tab.cookies = nil
+	tab.authURL = ""
+	tab.intercept = false
+	tab.bypassCSP = false
+	tab.touch = false
+	tab.userAgent = false
+}
+
+/*
+resetCommands returns the commands that undo the state added during a job, in
+the order they are sent
+*/
+func (tab *Tab) resetCommands() []tabCommand {
+	commands := []tabCommand{{"Emulation.clearDeviceMetricsOverride", func(ctx context.Context) error {
+		var result *emulation.ClearDeviceMetricsOverrideResult
+		if err := await(ctx, tab.Emulation().ClearDeviceMetricsOverride(), &result); nil != err {
+			return err
+		}
+		return result.CDTPError
+	}}}
+
+	if tab.touch {
+		commands = append(commands, tabCommand{"Emulation.setTouchEmulationEnabled", func(ctx context.Context) error {
+			var result *emulation.SetTouchEmulationEnabledResult
+			if err := await(ctx, tab.Emulation().SetTouchEmulationEnabled(&emulation.SetTouchEmulationEnabledParams{
+				Enabled: false,
+			}), &result); nil != err {
+				return err
+			}
+			return result.CDTPError
+		}})
+	}
+
+	if tab.userAgent {
+		commands = append(commands, tabCommand{"Network.setUserAgentOverride", func(ctx context.Context) error {
+			var result *network.SetUserAgentOverrideResult
+			if err := await(ctx, tab.Network().SetUserAgentOverride(&network.SetUserAgentOverrideParams{
+				UserAgent: "",
+			}), &result); nil != err {
+				return err
+			}
+			return result.CDTPError
+		}})
+	}
+
+	commands = append(commands, tabCommand{"Emulation.setEmulatedMedia", func(ctx context.Context) error {
+		var result *emulation.SetEmulatedMediaResult
+		if err := await(ctx, tab.Emulation().SetEmulatedMedia(&emulation.SetEmulatedMediaParams{
+			Media: "",
+		}), &result); nil != err {
+			return err
+		}
+		return result.CDTPError
+	}})
+
+	if tab.bypassCSP {
+		commands = append(commands, tabCommand{"Page.setBypassCSP", func(ctx context.Context) error {
+			var result *page.SetBypassCSPResult
+			if err := await(ctx, tab.Page().SetBypassCSP(&page.SetBypassCSPParams{
+				Enabled: false,
+			}), &result); nil != err {
+				return err
+			}
+			return result.CDTPError
+		}})
+	}
+
+	for _, script := range tab.scripts {
+		script := script
+		commands = append(commands, tabCommand{"Page.removeScriptToEvaluateOnNewDocument", func(ctx context.Context) error {
+			var result *page.RemoveScriptToEvaluateOnNewDocumentResult
+			if err := await(ctx, tab.Page().RemoveScriptToEvaluateOnNewDocument(&page.RemoveScriptToEvaluateOnNewDocumentParams{
+				Identifier: script,
+			}), &result); nil != err {
+				return err
+			}
+			return result.CDTPError
+		}})
+	}
+
+	if tab.headers {
+		commands = append(commands, tabCommand{"Network.setExtraHTTPHeaders", func(ctx context.Context) error {
+			var result *network.SetExtraHTTPHeadersResult
+			if err := await(ctx, tab.Network().SetExtraHTTPHeaders(&network.SetExtraHTTPHeadersParams{
+				Headers: network.Headers{},
+			}), &result); nil != err {
+				return err
+			}
+			return result.CDTPError
+		}})
+	}
+
+	if tab.intercept {
+		commands = append(commands, tabCommand{"Network.setRequestInterception", func(ctx context.Context) error {
+			var result *network.SetRequestInterceptionResult
+			if err := await(ctx, tab.Network().SetRequestInterception(&network.SetRequestInterceptionParams{
+				Patterns: []*network.RequestPattern{},
+			}), &result); nil != err {
+				return err
+			}
+			return result.CDTPError
+		}})
+	}
+
+	// Cookies are shared by all tabs. The job's own cookies are deleted, and
+	// so are the cookies a site set in response to the job's credentials.
+	for _, cookie := range tab.cookies {
+		commands = append(commands, tab.deleteCookie(cookie))
+	}
+	if "" != tab.authURL {
+		commands = append(commands, tabCommand{"Network.getCookies", func(ctx context.Context) error {
+			var result *network.GetCookiesResult
+			if err := await(ctx, tab.Network().GetCookies(&network.GetCookiesParams{
+				URLs: []string{tab.authURL},
+			}), &result); nil != err {
+				return err
+			} else if nil != result.CDTPError {
+				return result.CDTPError
+			}
+			for _, cookie := range result.Cookies {
+				if err := tab.deleteCookie(&network.CookieParam{
+					Name:   cookie.Name,
+					Domain: cookie.Domain,
+					Path:   cookie.Path,
+				}).send(ctx); nil != err {
+					return err
+				}
+			}
+			return nil
+		}})
+	}
+
+	return append(commands, tabCommand{"Network.disable", func(ctx context.Context) error {
+		var result *network.DisableResult
+		if err := await(ctx, tab.Network().Disable(), &result); nil != err {
+			return err
+		}
+		return result.CDTPError
+	}}, tabCommand{"Page.navigate", func(ctx context.Context) error {
+		var result *page.NavigateResult
+		if err := await(ctx, tab.Page().Navigate(&page.NavigateParams{
+			URL: "about:blank",
+		}), &result); nil != err {
+			return err
+		}
+		return result.CDTPError
+	}})
+}
+
+/*
+deleteCookie returns the command that deletes a cookie
+*/
+func (tab *Tab) deleteCookie(cookie *network.CookieParam) tabCommand {
+	return tabCommand{"Network.deleteCookies", func(ctx context.Context) error {
+		var result *network.DeleteCookiesResult
+		if err := await(ctx, tab.Network().DeleteCookies(&network.DeleteCookiesParams{
+			Name:   cookie.Name,
+			URL:    cookie.URL,
+			Domain: cookie.Domain,
+			Path:   cookie.Path,
+		}), &result); nil != err {
+			return err
+		}
+		return result.CDTPError
+	}}
+}
+
+/*
+closeTab closes a browser tab
+*/
+func closeTab(tab *Tab) {
+	if _, err := tab.Close(); nil != err {
+		log.Errorf("Failed to close tab: %s", err)
+	}
+}
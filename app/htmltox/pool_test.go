@@ -0,0 +1,119 @@
+package htmltox
+
+import (
+	"context"
+	"testing"
+
+	chrome "github.com/mkenney/go-chrome"
+	"github.com/mkenney/go-chrome/cdtp/network"
+	"github.com/mkenney/go-chrome/cdtp/page"
+)
+
+/*
+fakeBrowser opens tabs without a browser
+*/
+type fakeBrowser struct {
+	chrome.Chromium
+	opened int
+}
+
+/*
+NewTab implements chrome.Chromium
+*/
+func (browser *fakeBrowser) NewTab(url string) (*chrome.Tab, error) {
+	browser.opened++
+	return &chrome.Tab{}, nil
+}
+
+/*
+TestPoolReuse checks that a released tab is reset and reused, and that none of
+the previous job's state is left on it
+*/
+func TestPoolReuse(t *testing.T) {
+	browser := &fakeBrowser{}
+	pool := NewPool(1, 0)
+	pool.Reset(browser)
+
+	// The browser commands are recorded instead of sent
+	sent := map[string]int{}
+	pool.reset = func(tab *Tab, ctx context.Context) error {
+		for _, command := range tab.resetCommands() {
+			sent[command.method]++
+		}
+		tab.clear()
+		return nil
+	}
+
+	tab, err := pool.Acquire(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	tab.scripts = []page.ScriptIdentifier{"1", "2"}
+	tab.headers = true
+	tab.cookies = []*network.CookieParam{{Name: "session", URL: "http://example.com/"}}
+	tab.authURL = "http://example.com/"
+	tab.intercept = true
+	tab.bypassCSP = true
+	tab.touch = true
+	tab.userAgent = true
+	pool.Release(tab)
+
+	reused, err := pool.Acquire(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer pool.Release(reused)
+	if tab != reused || 1 != browser.opened {
+		t.Fatalf("Expected the released tab to be reused, %d tabs were opened", browser.opened)
+	}
+
+	if reused.headers || nil != reused.cookies || "" != reused.authURL || reused.intercept ||
+		reused.bypassCSP || reused.touch || reused.userAgent || nil != reused.scripts {
+		t.Errorf("Expected a clean tab, got %+v", reused)
+	}
+
+	for method, count := range map[string]int{
+		"Emulation.clearDeviceMetricsOverride":     1,
+		"Emulation.setTouchEmulationEnabled":       1,
+		"Emulation.setEmulatedMedia":               1,
+		"Network.setUserAgentOverride":             1,
+		"Network.setExtraHTTPHeaders":              1,
+		"Network.setRequestInterception":           1,
+		"Network.deleteCookies":                    1,
+		"Network.getCookies":                       1,
+		"Network.disable":                          1,
+		"Page.setBypassCSP":                        1,
+		"Page.removeScriptToEvaluateOnNewDocument": 2,
+		"Page.navigate":                            1,
+	} {
+		if count != sent[method] {
+			t.Errorf("Expected %d %s commands, got %d", count, method, sent[method])
+		}
+	}
+}
+
+/*
+TestPoolResetCommands checks that an unused tab is only cleared of the state
+every job sets
+*/
+func TestPoolResetCommands(t *testing.T) {
+	tab := &Tab{}
+	methods := []string{}
+	for _, command := range tab.resetCommands() {
+		methods = append(methods, command.method)
+	}
+	expected := []string{
+		"Emulation.clearDeviceMetricsOverride",
+		"Emulation.setEmulatedMedia",
+		"Network.disable",
+		"Page.navigate",
+	}
+	if len(expected) != len(methods) {
+		t.Fatalf("Expected commands %v, got %v", expected, methods)
+	}
+	for a, method := range expected {
+		if method != methods[a] {
+			t.Errorf("Expected command %d to be %s, got %s", a, method, methods[a])
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package htmltox
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+	"github.com/mkenney/docker-htmltox/app/imaging"
+)
+
+/*
+Crop is the rectangle of a capture to keep, in image pixels. It is written as
+'x,y,width,height'.
+*/
+type Crop struct {
+	image.Rectangle
+}
+
+/*
+MarshalText implements encoding.TextMarshaler
+*/
+func (crop Crop) MarshalText() ([]byte, error) {
+	if crop.Empty() {
+		return []byte{}, nil
+	}
+	return []byte(fmt.Sprintf("%d,%d,%d,%d", crop.Min.X, crop.Min.Y, crop.Dx(), crop.Dy())), nil
+}
+
+/*
+UnmarshalText implements encoding.TextUnmarshaler
+*/
+func (crop *Crop) UnmarshalText(text []byte) error {
+	return crop.decodeParam("crop", string(text))
+}
+
+/*
+decodeParam parses a 'x,y,width,height' crop rectangle
+*/
+func (crop *Crop) decodeParam(name, value string) error {
+	if "" == value {
+		crop.Rectangle = image.Rectangle{}
+		return nil
+	}
+	parts := strings.Split(value, ",")
+	nums := make([]int, len(parts))
+	for a, part := range parts {
+		num, err := strconv.Atoi(strings.TrimSpace(part))
+		if nil != err {
+			nums = nil
+			break
+		}
+		nums[a] = num
+	}
+	if 4 != len(nums) || 0 > nums[0] || 0 > nums[1] || 1 > nums[2] || 1 > nums[3] {
+		return api.InvalidParam(name, "Invalid crop '%s', must be 'x,y,width,height' with a positive width and height", value)
+	}
+	crop.Rectangle = image.Rect(nums[0], nums[1], nums[0]+nums[2], nums[1]+nums[3])
+	return nil
+}
+
+/*
+validateProcessOptions validates the image processing options
+*/
+func validateProcessOptions(options *RenderOptions) error {
+	if 0 > options.Crop.Min.X || 0 > options.Crop.Min.Y {
+		return api.InvalidParam("crop", "Invalid crop, the x and y offsets may not be negative")
+	} else if 0 > options.ResizeWidth {
+		return api.InvalidParam("resize-width", "Invalid resize-width '%d', must be a positive integer", options.ResizeWidth)
+	}
+
+	if processImage(options) && "pdf" == options.Format {
+		return api.InvalidParam("crop", "The 'crop', 'resize-width' and 'grayscale' params do not apply to the 'pdf' format")
+	}
+
+	return nil
+}
+
+/*
+processImage returns true if the image processing options are set
+*/
+func processImage(options *RenderOptions) bool {
+	return !options.Crop.Empty() || 0 != options.ResizeWidth || options.Grayscale
+}
+
+/*
+process applies the image processing options to a captured image. PNG and
+JPEG images are encoded by the imaging package, WebP images by the browser.
+*/
+func process(ctx context.Context, tab *Tab, data []byte, options *RenderOptions) ([]byte, error) {
+	if !processImage(options) {
+		return data, nil
+	}
+	format := options.Format
+	if "webp" == format {
+		format = "png"
+	}
+	processed, err := imaging.Process(data, format, imaging.Options{
+		Crop:      options.Crop.Rectangle,
+		Width:     options.ResizeWidth,
+		Grayscale: options.Grayscale,
+		Quality:   options.Quality,
+	})
+	if nil != err || "webp" != options.Format {
+		return processed, err
+	}
+	return encodeWebP(ctx, tab, processed, options.Quality)
+}
+
+/*
+encodeWebP encodes a PNG image as WebP with the browser's canvas encoder, at
+quality 1 - 100 or the browser default quality if it's zero
+*/
+func encodeWebP(ctx context.Context, tab *Tab, data []byte, quality int) ([]byte, error) {
+	encoded, _ := json.Marshal(base64.StdEncoding.EncodeToString(data))
+	result, err := evaluate(ctx, tab, fmt.Sprintf(
+		`(async function () {
+			var bytes = Uint8Array.from(atob(%s), function (char) { return char.charCodeAt(0) });
+			var bitmap = await createImageBitmap(new Blob([bytes], {type: 'image/png'}));
+			var canvas = new OffscreenCanvas(bitmap.width, bitmap.height);
+			canvas.getContext('2d').drawImage(bitmap, 0, 0);
+			var blob = await canvas.convertToBlob({type: 'image/webp', quality: %d > 0 ? %d / 100 : undefined});
+			var webp = new Uint8Array(await blob.arrayBuffer());
+			var binary = '';
+			for (var a = 0; a < webp.length; a += 0x8000) {
+				binary += String.fromCharCode.apply(null, webp.subarray(a, a + 0x8000));
+			}
+			return btoa(binary);
+		})()`,
+		encoded,
+		quality,
+		quality,
+	))
+	if nil != err {
+		return nil, err
+	} else if nil != result.ExceptionDetails {
+		return nil, fmt.Errorf("Failed to encode the WebP image: %s", exceptionMessage(result.ExceptionDetails))
+	}
+	webp, _ := result.Result.Value.(string)
+	return base64.StdEncoding.DecodeString(webp)
+}
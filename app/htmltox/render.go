@@ -0,0 +1,598 @@
+package htmltox
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"image"
+	"net/http"
+	"time"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+	"github.com/mkenney/docker-htmltox/app/imaging"
+	"github.com/mkenney/docker-htmltox/app/storage"
+	"github.com/mkenney/go-chrome/cdtp/page"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+renderGracePeriod is the time allowed for rendering after the 'timeout' period.
+Requests that take longer than that fail with context.DeadlineExceeded.
+*/
+const renderGracePeriod = 15 * time.Second
+
+/*
+ErrMaxBytes is returned when an image does not fit in the 'max-bytes' option
+even at the lowest quality
+*/
+var ErrMaxBytes = errors.New("The image exceeds 'max-bytes' even at the lowest quality")
+
+/*
+qualityStep is how much the quality is lowered each time an image is encoded
+again to fit in the 'max-bytes' parameter
+*/
+const qualityStep = 10
+
+/*
+minQuality is the lowest quality an image is encoded at to fit in the
+'max-bytes' parameter
+*/
+const minQuality = 10
+
+/*
+ErrNoStorage is returned when a result should be stored but no storage backend
+is configured
+*/
+var ErrNoStorage = errors.New("The 'store' param requires a storage backend, STORAGE is not configured")
+
+/*
+Result is a rendered image or PDF document
+
+If the result has been written to the storage backend Object describes it and
+Data is empty.
+*/
+type Result struct {
+	Data        []byte
+	ContentType string
+	Object      *storage.Object
+
+	// Cached is true if the result was served from the render cache
+	Cached bool
+
+	// Status is the response status of a batch result whose renders didn't
+	// all succeed, 0 means 200
+	Status int
+}
+
+/*
+status returns the response status of the result
+*/
+func (result *Result) status() int {
+	if 0 == result.Status {
+		return 200
+	}
+	return result.Status
+}
+
+/*
+Source is what a render loads, either the page at URL or the HTML document
+*/
+type Source struct {
+	URL  string
+	HTML string
+}
+
+/*
+outcome is sent from the render goroutine when the job completes
+*/
+type outcome struct {
+	result *Result
+	err    error
+}
+
+/*
+Render loads the source in a pooled tab and renders it according to the
+validated options. The options are not modified.
+
+The page is rendered as soon as the wait conditions are met, or when the
+'timeout' period expires. Rendering is abandoned if ctx is canceled or the
+browser dies.
+
+Results are cached by their options and source. The 'nocache' option bypasses
+the cache lookup.
+*/
+func (htmltox *HTMLToX) Render(ctx context.Context, options *RenderOptions, source Source) (*Result, error) {
+	key := cacheKey(options, source)
+	if !options.NoCache {
+		if cached, ok := htmltox.Cache.Get(key); ok {
+			log.Debugf("Render cache hit")
+			result := *cached
+			result.Cached = true
+			return &result, nil
+		}
+	}
+
+	// Jobs wait for a tab as long as it takes and their timeout starts once
+	// they have one, requests only wait until their timeout
+	queued := waitsForTab(ctx)
+	var tab *Tab
+	var err error
+	if queued {
+		if tab, err = htmltox.Pool.Acquire(ctx); nil != err {
+			return nil, err
+		}
+	}
+
+	timeout := time.Duration(options.Timeout) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout+renderGracePeriod)
+	defer cancel()
+
+	if !queued {
+		if tab, err = htmltox.Pool.Acquire(ctx); nil != err {
+			return nil, err
+		}
+	}
+
+	// The render resizes the viewport in its own copy of the options
+	copied := *options
+
+	// The tab isn't released until the job finishes. Every browser call
+	// watches ctx, so an abandoned job finishes promptly and its tab, which
+	// may be stuck in the page's scripts, is closed rather than reused.
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := htmltox.renderTab(ctx, tab, &copied, source, timeout)
+		if nil != ctx.Err() {
+			htmltox.Pool.Discard(tab)
+		} else {
+			htmltox.Pool.Release(tab)
+		}
+		if nil == err {
+			htmltox.Cache.Set(key, result)
+		} else if nil == ctx.Err() && 500 == renderError(err).Status {
+			// Unexpected failures are usually DevTools socket errors
+			htmltox.Pool.failed()
+		}
+		done <- outcome{result: result, err: err}
+	}()
+
+	select {
+	case outcome := <-done:
+		return outcome.result, outcome.err
+	case <-ctx.Done():
+		log.Warnf("Render abandoned: %s", ctx.Err())
+		return nil, ctx.Err()
+	case <-tab.Dead():
+		return nil, ErrBrowserRestarting
+	}
+}
+
+/*
+renderTab runs a render job in a tab
+*/
+func (htmltox *HTMLToX) renderTab(
+	ctx context.Context,
+	tab *Tab,
+	options *RenderOptions,
+	source Source,
+	timeout time.Duration,
+) (*Result, error) {
+
+	// Enable Page events
+	var enableResult *page.EnableResult
+	if err := await(ctx, tab.Page().Enable(), &enableResult); nil != err {
+		return nil, err
+	}
+	if nil != enableResult.CDTPError {
+		log.Errorf("Page.Enable: %s", enableResult.CDTPError.Error())
+		return nil, enableResult.CDTPError
+	}
+
+	// Set the viewport stuff
+	if err := setViewport(ctx, tab.Tab, options); nil != err {
+		return nil, err
+	}
+	if err := setDevice(ctx, tab, options); nil != err {
+		return nil, err
+	}
+	if err := setMedia(ctx, tab, options); nil != err {
+		return nil, err
+	}
+	if err := bypassCSP(ctx, tab, options); nil != err {
+		return nil, err
+	}
+
+	// Set the request headers, cookies and credentials
+	if err := setNetwork(ctx, tab, options, source.URL); nil != err {
+		return nil, err
+	}
+	if err := setAuth(ctx, tab, options, source.URL); nil != err {
+		return nil, err
+	}
+
+	// Install the script that runs before the page's own scripts. HTML
+	// content is written into a new blank document, which runs it.
+	scriptBefore, err := addScriptBefore(ctx, tab, options)
+	if nil != err {
+		return nil, err
+	}
+	if "" != source.HTML {
+		if err := openBlank(ctx, tab); nil != err {
+			return nil, err
+		}
+	}
+
+	// Watch for the page events the wait conditions depend on
+	waiter, err := newWaiter(ctx, tab, options)
+	if nil != err {
+		return nil, err
+	}
+
+	// Load the source once the event handlers are in place
+	if err := load(ctx, tab, source); nil != err {
+		return nil, err
+	}
+
+	// Render as soon as the page is ready, or force a render after the
+	// timeout
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := waiter.Wait(waitCtx); context.DeadlineExceeded == err && nil == ctx.Err() {
+		log.Warnf("Wait conditions were not met within %s, rendering anyway", timeout)
+	} else if nil != err {
+		return nil, err
+	}
+
+	// Report script errors, then add the stylesheet and run the script that
+	// prepares the capture
+	if err := scriptBefore.Err(); nil != err {
+		return nil, err
+	}
+	if err := injectCSS(ctx, tab, options); nil != err {
+		return nil, err
+	}
+	if err := runScriptAfter(ctx, tab, options); nil != err {
+		return nil, err
+	}
+
+	data, err := htmltox.capture(ctx, tab, options)
+	if nil != err {
+		return nil, err
+	}
+	return &Result{
+		Data:        data,
+		ContentType: contentType(options.Format),
+	}, nil
+}
+
+/*
+load navigates the tab to the source URL, or writes the source HTML into its
+document. HTML is written directly because the size of a data URL is limited.
+*/
+func load(ctx context.Context, tab *Tab, source Source) error {
+	if "" == source.HTML {
+		var navigateResult *page.NavigateResult
+		if err := await(ctx, tab.Page().Navigate(&page.NavigateParams{
+			URL: source.URL,
+		}), &navigateResult); nil != err {
+			return err
+		}
+		if nil != navigateResult.CDTPError {
+			log.Errorf("Page.Navigate: %s", navigateResult.CDTPError.Error())
+			return navigateResult.CDTPError
+		}
+		return nil
+	}
+
+	var frameResult *page.GetFrameTreeResult
+	if err := await(ctx, tab.Page().GetFrameTree(), &frameResult); nil != err {
+		return err
+	}
+	if nil != frameResult.CDTPError {
+		log.Errorf("Page.getFrameTree: %s", frameResult.CDTPError.Error())
+		return frameResult.CDTPError
+	}
+
+	var contentResult *page.SetDocumentContentResult
+	if err := await(ctx, tab.Page().SetDocumentContent(&page.SetDocumentContentParams{
+		FrameID: frameResult.FrameTree.Frame.ID,
+		HTML:    source.HTML,
+	}), &contentResult); nil != err {
+		return err
+	}
+	if nil != contentResult.CDTPError {
+		log.Errorf("Page.setDocumentContent: %s", contentResult.CDTPError.Error())
+		return contentResult.CDTPError
+	}
+	return nil
+}
+
+/*
+openBlank loads a new blank document and waits until it's complete, so that
+its load events are not mistaken for those of the HTML written into it
+*/
+func openBlank(ctx context.Context, tab *Tab) error {
+	var navigateResult *page.NavigateResult
+	if err := await(ctx, tab.Page().Navigate(&page.NavigateParams{
+		URL: "about:blank",
+	}), &navigateResult); nil != err {
+		return err
+	}
+	if nil != navigateResult.CDTPError {
+		log.Errorf("Page.Navigate: %s", navigateResult.CDTPError.Error())
+		return navigateResult.CDTPError
+	}
+
+	for {
+		result, err := evaluate(ctx, tab, "document.readyState")
+		if nil != err {
+			return err
+		} else if state, _ := result.Result.Value.(string); "complete" == state {
+			return nil
+		}
+		select {
+		case <-time.After(waitPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+/*
+capture renders the tab contents in the requested format and applies the image
+processing options. If the 'max-bytes' option is set the image is encoded at
+lower qualities until it fits.
+*/
+func (htmltox *HTMLToX) capture(ctx context.Context, tab *Tab, options *RenderOptions) ([]byte, error) {
+	var data string
+	var err error
+	if "pdf" == options.Format {
+		data, err = renderPDF(ctx, tab.Tab, options)
+	} else {
+		data, err = htmltox.screenshot(ctx, tab, options)
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if nil != err {
+		return nil, err
+	} else if 0 < options.MaxBytes {
+		return fitMaxBytes(ctx, tab, decoded, options)
+	}
+	return process(ctx, tab, decoded, options)
+}
+
+/*
+fitMaxBytes processes a PNG capture and encodes it at decreasing qualities,
+starting at the 'quality' option, until it fits in the 'max-bytes' option. The
+quality is lowered by qualityStep, minQuality is always tried last.
+*/
+func fitMaxBytes(ctx context.Context, tab *Tab, data []byte, options *RenderOptions) ([]byte, error) {
+	lossless := *options
+	lossless.Format = "png"
+	data, err := process(ctx, tab, data, &lossless)
+	if nil != err {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if nil != err {
+		return nil, err
+	}
+
+	quality := options.Quality
+	for {
+		var encoded []byte
+		if "webp" == options.Format {
+			encoded, err = encodeWebP(ctx, tab, data, quality)
+		} else {
+			encoded, err = imaging.Encode(img, options.Format, quality)
+		}
+		if nil != err || len(encoded) <= options.MaxBytes {
+			return encoded, err
+		} else if quality <= minQuality {
+			return nil, ErrMaxBytes
+		}
+		log.Debugf("Image is %d bytes at quality %d, encoding it at a lower quality", len(encoded), quality)
+		if quality -= qualityStep; quality < minQuality {
+			quality = minQuality
+		}
+	}
+}
+
+/*
+screenshot captures the requested area of the tab contents and returns the
+base64 encoded image. Images that are processed or fitted to 'max-bytes'
+afterwards are captured as lossless PNG and encoded in the requested format by
+the processing.
+*/
+func (htmltox *HTMLToX) screenshot(ctx context.Context, tab *Tab, options *RenderOptions) (string, error) {
+	var clip *page.Viewport
+	var err error
+	if "" != options.Selector {
+		clip, err = getSelectorClip(ctx, tab.Tab, options, htmltox.Config.Render.MaxPageWidth, htmltox.Config.Render.MaxPageHeight)
+	} else if options.FullPage {
+		err = resizeToContent(ctx, tab.Tab, options, htmltox.Config.Render.MaxPageHeight)
+		clip = getClip(options)
+	} else {
+		clip = getClip(options)
+	}
+	if nil != err {
+		return "", err
+	}
+
+	if processImage(options) || 0 < options.MaxBytes {
+		return renderScreenshot(ctx, tab.Tab, "png", 0, clip)
+	}
+	return renderScreenshot(ctx, tab.Tab, options.Format, options.Quality, clip)
+}
+
+/*
+render renders the source and writes the result, or an error, as the
+response. Exactly one response is written.
+*/
+func (htmltox *HTMLToX) render(
+	response http.ResponseWriter,
+	request *http.Request,
+	options *RenderOptions,
+	source Source,
+) {
+	err := htmltox.checkStore(options)
+	var result *Result
+	if nil == err {
+		result, err = htmltox.Render(request.Context(), options, source)
+	}
+	if nil == err {
+		result, err = htmltox.store(result, options)
+	}
+	if nil != err {
+		htmltox.API.RespondWithError(request, response, renderError(err))
+		return
+	}
+
+	headers := cacheHeaders(result, options)
+	headers["X-Cache"] = "MISS"
+	if result.Cached {
+		headers["X-Cache"] = "HIT"
+	}
+	htmltox.respondWithResult(response, request, result, headers)
+}
+
+/*
+privatePolicy is the cache policy of renders made with credentials, which only
+the client may keep
+*/
+const privatePolicy = "private, no-store"
+
+/*
+cacheHeaders returns the response headers that let clients cache a result.
+Rendered output is tagged with an ETag derived from its content so clients can
+revalidate it. Stored results and renders requested with 'nocache' are not
+cacheable, and renders made with request headers, cookies or credentials are
+not stored by any cache.
+*/
+func cacheHeaders(result *Result, options *RenderOptions) map[string]string {
+	headers := make(map[string]string)
+	if nil != result.Object || options.NoCache {
+		headers["Cache-Control"] = api.NoCache
+		return headers
+	}
+	if hasCredentials(options) {
+		headers["Cache-Control"] = privatePolicy
+	}
+	headers["ETag"] = api.ETag(result.Data)
+	return headers
+}
+
+/*
+hasCredentials returns true if the render sends request headers, cookies or
+HTTP credentials, whose output may be private to the client
+*/
+func hasCredentials(options *RenderOptions) bool {
+	return 0 < len(options.Headers) || 0 < len(options.Cookies) || "" != options.Username
+}
+
+/*
+respondWithResult writes a result as the response, either the rendered output
+or a description of the stored object
+*/
+func (htmltox *HTMLToX) respondWithResult(
+	response http.ResponseWriter,
+	request *http.Request,
+	result *Result,
+	headers map[string]string,
+) {
+	if nil != result.Object {
+		htmltox.API.RespondWithJSONBody(
+			request,
+			response,
+			result.status(),
+			result.Object,
+			headers,
+		)
+		return
+	}
+
+	headers["Content-Type"] = result.ContentType
+	htmltox.API.RespondWithRawBody(
+		request,
+		response,
+		result.status(),
+		string(result.Data),
+		headers,
+	)
+}
+
+/*
+checkStore returns an error if the 'store' option is set but there is no
+storage backend
+*/
+func (htmltox *HTMLToX) checkStore(options *RenderOptions) error {
+	if options.Store && nil == htmltox.Storage {
+		return ErrNoStorage
+	}
+	return nil
+}
+
+/*
+store writes the result to the storage backend if the 'store' option is set and
+returns the stored result
+*/
+func (htmltox *HTMLToX) store(result *Result, options *RenderOptions) (*Result, error) {
+	if !options.Store {
+		return result, nil
+	}
+	object, err := storage.Store(htmltox.Storage, result.ContentType, result.Data, time.Duration(htmltox.Config.Storage.URLTTL)*time.Second)
+	if nil != err {
+		log.Errorf("Failed to store result: %s", err)
+		return nil, err
+	}
+	log.Debugf("Result stored as '%s'", object.Key)
+	return &Result{ContentType: result.ContentType, Object: object, Status: result.Status}, nil
+}
+
+/*
+renderError returns a render error as an *api.Error with the response code and
+headers to send
+*/
+func renderError(err error) *api.Error {
+	if apiErr, ok := err.(*api.Error); ok {
+		return apiErr
+	}
+	if scriptErr, ok := err.(*ScriptError); ok {
+		apiErr := api.NewError(422, api.CodeScriptError, "%s", scriptErr.Message)
+		apiErr.Param = scriptErr.Param
+		return apiErr
+	}
+	switch err {
+	case imaging.ErrEmptyCrop:
+		return api.UnprocessableParam("crop", "%s", err)
+	case ErrMaxBytes:
+		apiErr := api.NewError(422, api.CodeTooLarge, "%s", err)
+		apiErr.Param = "max-bytes"
+		return apiErr
+	case ErrNoStorage:
+		return api.InvalidParam("store", "%s", err)
+	case ErrPoolFull:
+		apiErr := api.NewError(503, api.CodeUnavailable, "%s", err)
+		apiErr.Headers = map[string]string{"Retry-After": "1"}
+		return apiErr
+	case ErrJobsFull:
+		apiErr := api.NewError(503, api.CodeUnavailable, "%s", err)
+		apiErr.Headers = map[string]string{"Retry-After": "5"}
+		return apiErr
+	case ErrBrowserRestarting:
+		apiErr := api.NewError(503, api.CodeUnavailable, "%s", err)
+		apiErr.Headers = map[string]string{"Retry-After": "5"}
+		return apiErr
+	case context.DeadlineExceeded:
+		return api.NewError(504, api.CodeTimeout, "The render did not complete within the timeout")
+	case context.Canceled:
+		log.Debugf("Client disconnected before the render completed")
+		return api.NewError(503, api.CodeUnavailable, "The request was canceled")
+	}
+	return api.NewError(500, api.CodeRenderFailed, "%s", err)
+}
@@ -0,0 +1,219 @@
+package htmltox
+
+import (
+	"context"
+	"math"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+	chrome "github.com/mkenney/go-chrome"
+	"github.com/mkenney/go-chrome/cdtp/dom"
+	"github.com/mkenney/go-chrome/cdtp/emulation"
+	"github.com/mkenney/go-chrome/cdtp/page"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+defaultViewportSize is the viewport width and height used when the 'width' and
+'height' options are not specified
+*/
+const defaultViewportSize = 1440
+
+/*
+setViewport sizes the tab viewport and sets the device metrics of the emulated
+device
+*/
+func setViewport(ctx context.Context, tab *chrome.Tab, options *RenderOptions) error {
+	device := getDevice(options)
+
+	var emulationSizeResult *emulation.SetVisibleSizeResult
+	if err := await(ctx, tab.Emulation().SetVisibleSize(&emulation.SetVisibleSizeParams{
+		Width:  device.Width,
+		Height: device.Height,
+	}), &emulationSizeResult); nil != err {
+		return err
+	}
+	if nil != emulationSizeResult.CDTPError {
+		log.Error(emulationSizeResult.CDTPError)
+	}
+
+	var emulationDeviceResult *emulation.SetDeviceMetricsOverrideResult
+	if err := await(ctx, tab.Emulation().SetDeviceMetricsOverride(&emulation.SetDeviceMetricsOverrideParams{
+		Width:             device.Width,
+		Height:            device.Height,
+		DeviceScaleFactor: device.Scale,
+		Mobile:            device.Mobile,
+		ScreenWidth:       device.Width,
+		ScreenHeight:      device.Height,
+		ScreenOrientation: device.orientation(),
+	}), &emulationDeviceResult); nil != err {
+		return err
+	}
+	if nil != emulationDeviceResult.CDTPError {
+		log.Errorf("Emulation.SetDeviceMetricsOverride: %s", emulationDeviceResult.CDTPError.Error())
+		return emulationDeviceResult.CDTPError
+	}
+	return nil
+}
+
+/*
+getClip returns the capture rectangle requested by the render options, a
+viewport-sized rectangle positioned at the 'x-offset' and 'y-offset' options
+*/
+func getClip(options *RenderOptions) *page.Viewport {
+	device := getDevice(options)
+	return &page.Viewport{
+		X:      float64(options.XOffset),
+		Y:      float64(options.YOffset),
+		Width:  float64(device.Width),
+		Height: float64(device.Height),
+		Scale:  1,
+	}
+}
+
+/*
+getSelectorClip returns the bounding rectangle of the first element matching
+the 'selector' option, expanded by the 'padding' option
+
+If the element extends beyond the viewport the viewport is resized to include
+it, up to maxWidth x maxHeight pixels, and the element is measured again in
+the new layout.
+*/
+func getSelectorClip(ctx context.Context, tab *chrome.Tab, options *RenderOptions, maxWidth, maxHeight int) (*page.Viewport, error) {
+	selector := options.Selector
+
+	var document *dom.GetDocumentResult
+	if err := await(ctx, tab.DOM().GetDocument(&dom.GetDocumentParams{}), &document); nil != err {
+		return nil, err
+	}
+	if nil != document.CDTPError {
+		log.Errorf("DOM.GetDocument: %s", document.CDTPError.Error())
+		return nil, document.CDTPError
+	}
+
+	var node *dom.QuerySelectorResult
+	if err := await(ctx, tab.DOM().QuerySelector(&dom.QuerySelectorParams{
+		NodeID:   document.Root.NodeID,
+		Selector: selector,
+	}), &node); nil != err {
+		return nil, err
+	}
+	if nil != node.CDTPError {
+		log.Errorf("DOM.QuerySelector: %s", node.CDTPError.Error())
+		return nil, node.CDTPError
+	} else if 0 == node.NodeID {
+		return nil, api.UnprocessableParam("selector", "No element matches the selector '%s'", selector)
+	}
+
+	clip, err := getElementClip(ctx, tab, node.NodeID, options, maxWidth, maxHeight)
+	if nil != err {
+		return nil, err
+	}
+
+	device := getDevice(options)
+	width, height := device.Width, device.Height
+	right, bottom := int(math.Ceil(clip.X+clip.Width)), int(math.Ceil(clip.Y+clip.Height))
+	if right <= width && bottom <= height {
+		return clip, nil
+	}
+
+	options.Width = int(math.Max(float64(width), float64(right)))
+	options.Height = int(math.Max(float64(height), float64(bottom)))
+	if err := setViewport(ctx, tab, options); nil != err {
+		return nil, err
+	}
+	return getElementClip(ctx, tab, node.NodeID, options, maxWidth, maxHeight)
+}
+
+/*
+getElementClip measures an element and returns its bounding rectangle expanded
+by the 'padding' option, within maxWidth x maxHeight pixels
+*/
+func getElementClip(ctx context.Context, tab *chrome.Tab, nodeID dom.NodeID, options *RenderOptions, maxWidth, maxHeight int) (*page.Viewport, error) {
+	var box *dom.GetBoxModelResult
+	if err := await(ctx, tab.DOM().GetBoxModel(&dom.GetBoxModelParams{
+		NodeID: nodeID,
+	}), &box); nil != err {
+		return nil, err
+	}
+	if nil != box.CDTPError {
+		log.Errorf("DOM.GetBoxModel: %s", box.CDTPError.Error())
+		return nil, box.CDTPError
+	}
+
+	// The border quad is 4 x,y vertex pairs
+	quad := box.Model.Border
+	left, top, right, bottom := quad[0], quad[1], quad[0], quad[1]
+	for a := 2; a+1 < len(quad); a += 2 {
+		left = math.Min(left, quad[a])
+		right = math.Max(right, quad[a])
+		top = math.Min(top, quad[a+1])
+		bottom = math.Max(bottom, quad[a+1])
+	}
+
+	padding := float64(options.Padding)
+	left = math.Max(0, left-padding)
+	top = math.Max(0, top-padding)
+	right = math.Min(float64(maxWidth), right+padding)
+	bottom = math.Min(float64(maxHeight), bottom+padding)
+	if right <= left || bottom <= top {
+		return nil, api.UnprocessableParam("selector", "The element matching the selector '%s' is not visible", options.Selector)
+	}
+
+	return &page.Viewport{
+		X:      left,
+		Y:      top,
+		Width:  right - left,
+		Height: bottom - top,
+		Scale:  1,
+	}, nil
+}
+
+/*
+renderScreenshot captures the clip rectangle of the tab contents as an image and
+returns the base64 encoded result. quality applies to the lossy formats, zero
+is the browser default.
+*/
+func renderScreenshot(ctx context.Context, tab *chrome.Tab, format string, quality int, clip *page.Viewport) (string, error) {
+	var result *page.CaptureScreenshotResult
+	if err := await(ctx, tab.Page().CaptureScreenshot(&page.CaptureScreenshotParams{
+		Format:  format,
+		Quality: quality,
+		Clip:    clip,
+	}), &result); nil != err {
+		return "", err
+	}
+	if nil != result.CDTPError {
+		log.Errorf("Page.CaptureScreenshot: %s", result.CDTPError.Error())
+		return "", result.CDTPError
+	}
+	log.Debugf("Screenshot rendered")
+	return result.Data, nil
+}
+
+/*
+resizeToContent measures the document and resizes the viewport to the full
+content height, up to maxHeight pixels
+*/
+func resizeToContent(ctx context.Context, tab *chrome.Tab, options *RenderOptions, maxHeight int) error {
+	var metrics *page.GetLayoutMetricsResult
+	if err := await(ctx, tab.Page().GetLayoutMetrics(), &metrics); nil != err {
+		return err
+	}
+	if nil != metrics.CDTPError {
+		log.Errorf("Page.GetLayoutMetrics: %s", metrics.CDTPError.Error())
+		return metrics.CDTPError
+	}
+
+	height := int(math.Ceil(metrics.ContentSize.Height))
+	if height > maxHeight {
+		log.Warnf("Content height %dpx exceeds the maximum, truncating to %dpx", height, maxHeight)
+		height = maxHeight
+	}
+	if height < 1 {
+		height = 1
+	}
+	options.Height = height
+
+	return setViewport(ctx, tab, options)
+}
@@ -0,0 +1,172 @@
+package htmltox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/mkenney/go-chrome/cdtp/page"
+	"github.com/mkenney/go-chrome/cdtp/runtime"
+	"github.com/mkenney/go-chrome/socket"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+scriptBeforeURL is the source URL of the 'script_before' script, which
+identifies the exceptions it throws
+*/
+const scriptBeforeURL = "htmltox://script_before.js"
+
+/*
+ScriptError is returned when a script from the render options throws an
+exception
+*/
+type ScriptError struct {
+	Param   string
+	Message string
+}
+
+/*
+Error implements error
+*/
+func (err *ScriptError) Error() string {
+	return fmt.Sprintf("The '%s' script failed: %s", err.Param, err.Message)
+}
+
+/*
+scriptException records the first exception thrown by the 'script_before'
+script
+*/
+type scriptException struct {
+	mux     sync.Mutex
+	message string
+}
+
+/*
+Err returns the recorded exception as a ScriptError, or nil
+*/
+func (exception *scriptException) Err() error {
+	if nil == exception {
+		return nil
+	}
+	exception.mux.Lock()
+	defer exception.mux.Unlock()
+	if "" == exception.message {
+		return nil
+	}
+	return &ScriptError{Param: "script_before", Message: exception.message}
+}
+
+/*
+addScriptBefore installs the 'script_before' script so that it runs in each
+new document before the page's own scripts. Syntax errors are reported
+immediately, the exceptions it throws are recorded from the Runtime events and
+reported by the returned scriptException. The script itself runs unchanged, so
+its top-level declarations stay global.
+*/
+func addScriptBefore(ctx context.Context, tab *Tab, options *RenderOptions) (*scriptException, error) {
+	script := options.ScriptBefore
+	if "" == script {
+		return nil, nil
+	}
+
+	var compileResult *runtime.CompileScriptResult
+	if err := await(ctx, tab.Runtime().CompileScript(&runtime.CompileScriptParams{
+		Expression:    script,
+		SourceURL:     scriptBeforeURL,
+		PersistScript: false,
+	}), &compileResult); nil != err {
+		return nil, err
+	}
+	if nil != compileResult.CDTPError {
+		log.Errorf("Runtime.compileScript: %s", compileResult.CDTPError.Error())
+		return nil, compileResult.CDTPError
+	} else if nil != compileResult.ExceptionDetails {
+		return nil, &ScriptError{Param: "script_before", Message: exceptionMessage(compileResult.ExceptionDetails)}
+	}
+
+	exception := &scriptException{}
+	tab.AddEventHandler(socket.NewEventHandler("Runtime.exceptionThrown", func(response *socket.Response) {
+		event := struct {
+			ExceptionDetails *runtime.ExceptionDetails `json:"exceptionDetails"`
+		}{}
+		if err := json.Unmarshal(response.Params, &event); nil != err {
+			log.Debugf("Failed to decode exception: %s", err)
+			return
+		}
+		if nil == event.ExceptionDetails || scriptBeforeURL != event.ExceptionDetails.URL {
+			return
+		}
+		exception.mux.Lock()
+		defer exception.mux.Unlock()
+		if "" == exception.message {
+			exception.message = exceptionMessage(event.ExceptionDetails)
+		}
+	}))
+
+	var enableResult *runtime.EnableResult
+	if err := await(ctx, tab.Runtime().Enable(), &enableResult); nil != err {
+		return nil, err
+	}
+	if nil != enableResult.CDTPError {
+		log.Errorf("Runtime.Enable: %s", enableResult.CDTPError.Error())
+		return nil, enableResult.CDTPError
+	}
+
+	var addResult *page.AddScriptToEvaluateOnNewDocumentResult
+	if err := await(ctx, tab.Page().AddScriptToEvaluateOnNewDocument(&page.AddScriptToEvaluateOnNewDocumentParams{
+		Source: fmt.Sprintf("%s\n//# sourceURL=%s", script, scriptBeforeURL),
+	}), &addResult); nil != err {
+		return nil, err
+	}
+	if nil != addResult.CDTPError {
+		log.Errorf("Page.addScriptToEvaluateOnNewDocument: %s", addResult.CDTPError.Error())
+		return nil, addResult.CDTPError
+	}
+	tab.scripts = append(tab.scripts, addResult.Identifier)
+	return exception, nil
+}
+
+/*
+runScriptAfter runs the 'script_after' script and waits for the promise it
+completes with, if any
+*/
+func runScriptAfter(ctx context.Context, tab *Tab, options *RenderOptions) error {
+	script := options.ScriptAfter
+	if "" == script {
+		return nil
+	}
+	result, err := evaluate(ctx, tab, script)
+	if nil != err {
+		return err
+	} else if nil != result.ExceptionDetails {
+		return &ScriptError{Param: "script_after", Message: exceptionMessage(result.ExceptionDetails)}
+	}
+	if nil != result.Result && nil != result.Result.Value {
+		value, _ := json.Marshal(result.Result.Value)
+		log.Debugf("script_after returned %s", value)
+	}
+	return nil
+}
+
+/*
+evaluate evaluates a script in the page, awaiting the promise it completes
+with, and returns its result unless ctx is done first
+*/
+func evaluate(ctx context.Context, tab *Tab, script string) (*runtime.EvaluateResult, error) {
+	var result *runtime.EvaluateResult
+	if err := await(ctx, tab.Runtime().Evaluate(&runtime.EvaluateParams{
+		Expression:    script,
+		ReturnByValue: true,
+		AwaitPromise:  true,
+	}), &result); nil != err {
+		return nil, err
+	}
+	if nil != result.CDTPError {
+		log.Errorf("Runtime.Evaluate: %s", result.CDTPError.Error())
+		return nil, result.CDTPError
+	}
+	return result, nil
+}
@@ -0,0 +1,94 @@
+package htmltox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+	"github.com/mkenney/go-chrome/cdtp/emulation"
+	"github.com/mkenney/go-chrome/cdtp/page"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+validateStyleOptions validates the 'media' option. By default screenshots use
+the 'screen' media type and PDFs use 'print'.
+*/
+func validateStyleOptions(options *RenderOptions) error {
+	switch options.Media {
+	case "", "print", "screen":
+	default:
+		return api.InvalidParam("media", "Invalid media '%s', must be either 'print' or 'screen'", options.Media)
+	}
+
+	return nil
+}
+
+/*
+setMedia emulates the 'media' CSS media type
+*/
+func setMedia(ctx context.Context, tab *Tab, options *RenderOptions) error {
+	if "" == options.Media {
+		return nil
+	}
+	var mediaResult *emulation.SetEmulatedMediaResult
+	if err := await(ctx, tab.Emulation().SetEmulatedMedia(&emulation.SetEmulatedMediaParams{
+		Media: options.Media,
+	}), &mediaResult); nil != err {
+		return err
+	}
+	if nil != mediaResult.CDTPError {
+		log.Errorf("Emulation.setEmulatedMedia: %s", mediaResult.CDTPError.Error())
+		return mediaResult.CDTPError
+	}
+	return nil
+}
+
+/*
+bypassCSP disables the page's Content-Security-Policy when the 'css' option is
+set, so that a style-src policy doesn't block the injected stylesheet. It must
+be set before the page loads, and is reset when the tab is released.
+*/
+func bypassCSP(ctx context.Context, tab *Tab, options *RenderOptions) error {
+	if "" == options.CSS {
+		return nil
+	}
+	tab.bypassCSP = true
+	var bypassResult *page.SetBypassCSPResult
+	if err := await(ctx, tab.Page().SetBypassCSP(&page.SetBypassCSPParams{
+		Enabled: true,
+	}), &bypassResult); nil != err {
+		return err
+	}
+	if nil != bypassResult.CDTPError {
+		log.Errorf("Page.setBypassCSP: %s", bypassResult.CDTPError.Error())
+		return bypassResult.CDTPError
+	}
+	return nil
+}
+
+/*
+injectCSS adds the 'css' stylesheet to the loaded page
+*/
+func injectCSS(ctx context.Context, tab *Tab, options *RenderOptions) error {
+	if "" == options.CSS {
+		return nil
+	}
+	css, _ := json.Marshal(options.CSS)
+	result, err := evaluate(ctx, tab, fmt.Sprintf(
+		`(function () {
+			var style = document.createElement('style');
+			style.textContent = %s;
+			(document.head || document.documentElement).appendChild(style);
+		})()`,
+		css,
+	))
+	if nil != err {
+		return err
+	} else if nil != result.ExceptionDetails {
+		return api.UnprocessableParam("css", "Failed to add the 'css' stylesheet: %s", exceptionMessage(result.ExceptionDetails))
+	}
+	return nil
+}
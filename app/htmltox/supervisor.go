@@ -0,0 +1,272 @@
+package htmltox
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mkenney/docker-htmltox/app/config"
+	chrome "github.com/mkenney/go-chrome"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Supervisor launches the browser, monitors its DevTools endpoint and relaunches
+it if it stops responding or its process exits
+
+When the browser dies the jobs using its tabs fail with ErrBrowserRestarting
+and the pool is reset with the relaunched browser.
+*/
+type Supervisor struct {
+	flags    *chrome.Flags
+	binary   string
+	endpoint string
+	interval time.Duration
+	pool     *Pool
+	client   *http.Client
+	check    chan struct{}
+	exited   chan chrome.Chromium
+
+	mux     sync.Mutex
+	browser chrome.Chromium
+}
+
+/*
+chromeFlags returns the browser command line flags for the Chrome settings.
+Flags from the settings are added to, and may replace, the defaults.
+*/
+func chromeFlags(cfg config.Chrome) *chrome.Flags {
+	flags := chrome.Flags{
+		"addr":                     []interface{}{"localhost"},
+		"disable-extensions":       nil,
+		"disable-gpu":              nil,
+		"headless":                 nil,
+		"hide-scrollbars":          nil,
+		"no-first-run":             nil,
+		"no-sandbox":               nil,
+		"port":                     []interface{}{cfg.Port},
+		"remote-debugging-address": []interface{}{"0.0.0.0"},
+		"remote-debugging-port":    []interface{}{cfg.Port},
+	}
+	if "" != cfg.Proxy {
+		flags["proxy-server"] = []interface{}{cfg.Proxy}
+	}
+	if "" != cfg.UserAgent {
+		flags["user-agent"] = []interface{}{cfg.UserAgent}
+	}
+	for _, flag := range cfg.Flags {
+		parts := strings.SplitN(strings.TrimLeft(flag, "-"), "=", 2)
+		if 1 == len(parts) {
+			flags[parts[0]] = nil
+		} else {
+			flags[parts[0]] = []interface{}{parts[1]}
+		}
+	}
+	return &flags
+}
+
+/*
+healthCheckFailures is the number of consecutive failed health checks before
+the browser is relaunched
+*/
+const healthCheckFailures = 3
+
+/*
+processPollInterval is how often the browser process is checked for exiting
+*/
+const processPollInterval = time.Second
+
+/*
+NewSupervisor returns a pointer to a Supervisor that launches the browser with
+flags and serves its tabs through pool. binary is the path to the Chrome
+executable, or empty for the default. endpoint is the DevTools HTTP address,
+e.g. "http://localhost:9222".
+*/
+func NewSupervisor(
+	flags *chrome.Flags,
+	binary,
+	endpoint string,
+	interval time.Duration,
+	pool *Pool,
+) *Supervisor {
+	supervisor := &Supervisor{
+		flags:    flags,
+		binary:   binary,
+		endpoint: endpoint,
+		interval: interval,
+		pool:     pool,
+		client:   &http.Client{Timeout: 2 * time.Second},
+		check:    make(chan struct{}, 1),
+		exited:   make(chan chrome.Chromium, 1),
+	}
+	pool.Failed = supervisor.Check
+	return supervisor
+}
+
+/*
+Launch starts the browser and begins monitoring it
+*/
+func (supervisor *Supervisor) Launch() error {
+	if err := supervisor.launch(); nil != err {
+		return err
+	}
+	go supervisor.monitor()
+	return nil
+}
+
+/*
+Browser returns the current browser process
+*/
+func (supervisor *Supervisor) Browser() chrome.Chromium {
+	supervisor.mux.Lock()
+	defer supervisor.mux.Unlock()
+	return supervisor.browser
+}
+
+/*
+Check requests an immediate health check, e.g. after a DevTools socket error
+*/
+func (supervisor *Supervisor) Check() {
+	select {
+	case supervisor.check <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Healthy checks whether the browser DevTools endpoint is responding
+*/
+func (supervisor *Supervisor) Healthy() error {
+	response, err := supervisor.client.Get(supervisor.endpoint + "/json/version")
+	if nil != err {
+		return err
+	}
+	response.Body.Close()
+	if 200 != response.StatusCode {
+		return fmt.Errorf("DevTools endpoint returned '%s'", response.Status)
+	}
+	return nil
+}
+
+/*
+launch starts a new browser process and resets the pool to use it
+*/
+func (supervisor *Supervisor) launch() error {
+	browser := chrome.New(supervisor.flags, supervisor.binary, "", "", "")
+	if err := browser.Launch(); nil != err {
+		log.Errorf("Failed to launch the browser: %s", err)
+		return err
+	}
+
+	supervisor.mux.Lock()
+	supervisor.browser = browser
+	supervisor.mux.Unlock()
+
+	supervisor.pool.Reset(browser)
+	go supervisor.watch(browser)
+	log.Info("Browser launched")
+	return nil
+}
+
+/*
+watch polls the browser process until it exits and reports it to the monitor.
+The process is never waited on, go-chrome reaps it when the browser is closed.
+Without /proc the monitor's health checks still apply.
+*/
+func (supervisor *Supervisor) watch(browser chrome.Chromium) {
+	if _, err := os.Stat("/proc/self/stat"); nil != err {
+		log.Debugf("Can't watch the browser process: %s", err)
+		return
+	}
+	stat := fmt.Sprintf("/proc/%d/stat", browser.Pid())
+
+	ticker := time.NewTicker(processPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Stopped browsers are no longer watched
+		if browser != supervisor.Browser() {
+			return
+		}
+		if processRunning(stat) {
+			continue
+		}
+		log.Errorf("Browser process %d exited", browser.Pid())
+		supervisor.exited <- browser
+		return
+	}
+}
+
+/*
+processRunning returns true if the /proc stat file of a process exists and the
+process isn't a zombie
+*/
+func processRunning(stat string) bool {
+	data, err := ioutil.ReadFile(stat)
+	if nil != err {
+		return false
+	}
+	// The state follows the command name, which is in parentheses
+	fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+	return 0 < len(fields) && "Z" != fields[0] && "X" != fields[0]
+}
+
+/*
+relaunch fails the jobs using the current browser, stops it and starts a new
+one
+*/
+func (supervisor *Supervisor) relaunch() error {
+	log.Warn("Relaunching the browser")
+	supervisor.pool.Fail()
+	if err := supervisor.Browser().Close(); nil != err {
+		log.Debugf("Failed to stop the browser: %s", err)
+	}
+	return supervisor.launch()
+}
+
+/*
+monitor health-checks the browser on each interval, or when a check is
+requested, and relaunches it after repeated failures or as soon as its process
+exits
+*/
+func (supervisor *Supervisor) monitor() {
+	ticker := time.NewTicker(supervisor.interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-supervisor.check:
+		case browser := <-supervisor.exited:
+			// Stopped browsers are reported too, only relaunch the current one
+			if browser == supervisor.Browser() {
+				failures = healthCheckFailures
+			}
+		}
+
+		if failures < healthCheckFailures {
+			err := supervisor.Healthy()
+			if nil == err {
+				failures = 0
+				continue
+			}
+			failures++
+			log.Errorf("Browser health check failed (%d/%d): %s", failures, healthCheckFailures, err)
+			if failures < healthCheckFailures {
+				continue
+			}
+		}
+
+		if err := supervisor.relaunch(); nil != err {
+			// Keep trying on the next interval
+			continue
+		}
+		failures = 0
+	}
+}
@@ -0,0 +1,39 @@
+package htmltox
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+TestProcessRunning checks that exited processes are detected without waiting
+on them
+*/
+func TestProcessRunning(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); nil != err {
+		t.Skip("/proc is not available")
+	}
+	if !processRunning("/proc/self/stat") {
+		t.Error("Expected the test process to be running")
+	}
+	if processRunning("/proc/0/stat") {
+		t.Error("Expected a missing process not to be running")
+	}
+
+	// An exited process that hasn't been reaped is a zombie
+	command := exec.Command("true")
+	if err := command.Start(); nil != err {
+		t.Skip(err)
+	}
+	defer command.Wait()
+	stat := "/proc/" + strconv.Itoa(command.Process.Pid) + "/stat"
+	for a := 0; a < 100 && processRunning(stat); a++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if processRunning(stat) {
+		t.Error("Expected the exited process not to be running")
+	}
+}
@@ -0,0 +1,324 @@
+package htmltox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mkenney/docker-htmltox/app/api"
+	"github.com/mkenney/go-chrome/cdtp/network"
+	"github.com/mkenney/go-chrome/cdtp/runtime"
+	"github.com/mkenney/go-chrome/socket"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+waitConditions lists the page events accepted by the 'wait' option
+*/
+var waitConditions = map[string]bool{
+	"domcontentloaded": true,
+	"fonts":            true,
+	"load":             true,
+	"networkidle":      true,
+}
+
+/*
+waitPollInterval is how often the selector and expression conditions are
+evaluated
+*/
+const waitPollInterval = 100 * time.Millisecond
+
+/*
+validateWaitOptions validates the wait condition options and populates their
+defaults. The 'wait' conditions may be comma separated and are split into
+separate values.
+*/
+func validateWaitOptions(options *RenderOptions) error {
+	conditions := []string{}
+	for _, value := range options.Wait {
+		for _, condition := range strings.Split(value, ",") {
+			condition = strings.ToLower(strings.TrimSpace(condition))
+			if !waitConditions[condition] {
+				return api.InvalidParam("wait", "Invalid wait '%s', must be one of 'load', 'domcontentloaded', 'networkidle' or 'fonts'", condition)
+			}
+			conditions = append(conditions, condition)
+		}
+	}
+	if 0 == len(conditions) {
+		conditions = []string{"load"}
+	}
+	options.Wait = conditions
+
+	if 0 > options.WaitDelay {
+		return api.InvalidParam("wait-delay", "Invalid wait-delay '%d'", options.WaitDelay)
+	} else if 0 > options.IdleTime {
+		return api.InvalidParam("idle-time", "Invalid idle-time '%d'", options.IdleTime)
+	} else if 0 == options.IdleTime {
+		options.IdleTime = 500
+	}
+
+	return nil
+}
+
+/*
+waiter tracks the page events that the wait conditions depend on
+*/
+type waiter struct {
+	tab     *Tab
+	options *RenderOptions
+
+	loaded      chan struct{}
+	domLoaded   chan struct{}
+	loadOnce    sync.Once
+	domLoadOnce sync.Once
+
+	mux        sync.Mutex
+	requests   map[string]bool
+	lastActive time.Time
+}
+
+/*
+newWaiter adds the event handlers needed by the wait conditions to the tab. It
+must be called before navigating.
+*/
+func newWaiter(ctx context.Context, tab *Tab, options *RenderOptions) (*waiter, error) {
+	waiter := &waiter{
+		tab:        tab,
+		options:    options,
+		loaded:     make(chan struct{}),
+		domLoaded:  make(chan struct{}),
+		requests:   make(map[string]bool),
+		lastActive: time.Now(),
+	}
+
+	tab.AddEventHandler(socket.NewEventHandler("Page.loadEventFired", func(response *socket.Response) {
+		waiter.loadOnce.Do(func() { close(waiter.loaded) })
+	}))
+	tab.AddEventHandler(socket.NewEventHandler("Page.domContentEventFired", func(response *socket.Response) {
+		waiter.domLoadOnce.Do(func() { close(waiter.domLoaded) })
+	}))
+
+	if waiter.has("networkidle") {
+		tab.AddEventHandler(socket.NewEventHandler("Network.requestWillBeSent", func(response *socket.Response) {
+			waiter.trackRequest(response, true)
+		}))
+		tab.AddEventHandler(socket.NewEventHandler("Network.loadingFinished", func(response *socket.Response) {
+			waiter.trackRequest(response, false)
+		}))
+		tab.AddEventHandler(socket.NewEventHandler("Network.loadingFailed", func(response *socket.Response) {
+			waiter.trackRequest(response, false)
+		}))
+		var enableResult *network.EnableResult
+		if err := await(ctx, tab.Network().Enable(&network.EnableParams{}), &enableResult); nil != err {
+			return nil, err
+		}
+		if nil != enableResult.CDTPError {
+			log.Errorf("Network.Enable: %s", enableResult.CDTPError.Error())
+			return nil, enableResult.CDTPError
+		}
+	}
+
+	return waiter, nil
+}
+
+/*
+Wait blocks until all of the wait conditions are met or the context is done
+*/
+func (waiter *waiter) Wait(ctx context.Context) error {
+	if waiter.has("load") {
+		if err := waitChan(ctx, waiter.loaded); nil != err {
+			return err
+		}
+		log.Debugf("Wait: load event fired")
+	}
+
+	if waiter.has("domcontentloaded") {
+		if err := waitChan(ctx, waiter.domLoaded); nil != err {
+			return err
+		}
+		log.Debugf("Wait: DOMContentLoaded event fired")
+	}
+
+	if waiter.has("networkidle") {
+		if err := waiter.poll(ctx, waiter.networkIdle); nil != err {
+			return err
+		}
+		log.Debugf("Wait: network is idle")
+	}
+
+	if selector := waiter.options.WaitSelector; "" != selector {
+		quoted, _ := json.Marshal(selector)
+		expression := fmt.Sprintf("null !== document.querySelector(%s)", quoted)
+		if err := waiter.poll(ctx, waiter.evaluator("wait-selector", expression)); nil != err {
+			return err
+		}
+		log.Debugf("Wait: selector '%s' matched", selector)
+	}
+
+	if expression := waiter.options.WaitExpression; "" != expression {
+		if err := waiter.poll(ctx, waiter.evaluator("wait-expression", expression)); nil != err {
+			return err
+		}
+		log.Debugf("Wait: expression is truthy")
+	}
+
+	if waiter.has("fonts") {
+		if _, err := waiter.evaluator("wait", "document.fonts.ready")(ctx); nil != err {
+			return err
+		}
+		log.Debugf("Wait: fonts are ready")
+	}
+
+	if delay := waiter.options.WaitDelay; delay > 0 {
+		select {
+		case <-time.After(time.Duration(delay) * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		log.Debugf("Wait: waited %dms", delay)
+	}
+
+	return nil
+}
+
+/*
+has returns true if the 'wait' option includes the condition
+*/
+func (waiter *waiter) has(condition string) bool {
+	for _, value := range waiter.options.Wait {
+		if condition == value {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+trackRequest records the start or end of a network request
+*/
+func (waiter *waiter) trackRequest(response *socket.Response, started bool) {
+	event := struct {
+		RequestID string `json:"requestId"`
+	}{}
+	if err := json.Unmarshal(response.Params, &event); nil != err {
+		log.Debugf("Failed to decode network event: %s", err)
+		return
+	}
+
+	waiter.mux.Lock()
+	defer waiter.mux.Unlock()
+	if started {
+		waiter.requests[event.RequestID] = true
+	} else {
+		delete(waiter.requests, event.RequestID)
+	}
+	waiter.lastActive = time.Now()
+}
+
+/*
+networkIdle returns true if there have been no requests in flight for the
+'idle-time' period
+*/
+func (waiter *waiter) networkIdle(ctx context.Context) (bool, error) {
+	idleTime := time.Duration(waiter.options.IdleTime) * time.Millisecond
+	waiter.mux.Lock()
+	defer waiter.mux.Unlock()
+	return 0 == len(waiter.requests) && time.Since(waiter.lastActive) >= idleTime, nil
+}
+
+/*
+evaluator returns a condition that evaluates a JavaScript expression in the page
+and reports whether the result is truthy. If the expression returns a promise
+the resolved value is used. Exceptions are reported as script errors of param.
+*/
+func (waiter *waiter) evaluator(param, expression string) func(ctx context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		result, err := evaluate(
+			ctx,
+			waiter.tab,
+			fmt.Sprintf("Promise.resolve(%s).then(function (value) { return !!value })", expression),
+		)
+		if nil != err {
+			return false, err
+		} else if nil != result.ExceptionDetails {
+			return false, &ScriptError{Param: param, Message: exceptionMessage(result.ExceptionDetails)}
+		}
+		truthy, _ := result.Result.Value.(bool)
+		return truthy, nil
+	}
+}
+
+/*
+poll checks a condition on each poll interval until it is met or the context
+is done. Script exceptions don't stop the polling, the condition is treated as
+not met and the last exception is returned if the context ends first.
+*/
+func (waiter *waiter) poll(ctx context.Context, condition func(ctx context.Context) (bool, error)) error {
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+	var scriptErr *ScriptError
+	for {
+		met, err := condition(ctx)
+		if exception, ok := err.(*ScriptError); ok {
+			scriptErr = exception
+		} else if nil != err && nil != scriptErr && nil != ctx.Err() {
+			return scriptErr
+		} else if nil != err {
+			return err
+		} else if met {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if nil != scriptErr {
+				return scriptErr
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+/*
+await blocks until a browser call returns its result, which is stored in result,
+a pointer to a variable of the call's result type, or until the context is done.
+Browser calls return their result on a channel.
+*/
+func await(ctx context.Context, call interface{}, result interface{}) error {
+	chosen, value, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(call)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	})
+	if 1 == chosen {
+		return ctx.Err()
+	}
+	reflect.ValueOf(result).Elem().Set(value)
+	return nil
+}
+
+/*
+waitChan blocks until the channel is closed or the context is done
+*/
+func waitChan(ctx context.Context, ch <-chan struct{}) error {
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+exceptionMessage returns a readable message for a JavaScript exception
+*/
+func exceptionMessage(details *runtime.ExceptionDetails) string {
+	if nil != details.Exception && "" != details.Exception.Description {
+		return details.Exception.Description
+	}
+	return fmt.Sprintf("%s (line %d, column %d)", details.Text, details.LineNumber, details.ColumnNumber)
+}
@@ -0,0 +1,39 @@
+package htmltox
+
+import (
+	"context"
+	"testing"
+)
+
+/*
+awaitResult is a browser call result used by the tests
+*/
+type awaitResult struct {
+	Value string
+}
+
+/*
+TestAwait checks that a call's result is returned, and that a done context
+stops the wait
+*/
+func TestAwait(t *testing.T) {
+	call := make(chan *awaitResult, 1)
+	call <- &awaitResult{Value: "done"}
+	var result *awaitResult
+	if err := await(context.Background(), call, &result); nil != err {
+		t.Fatal(err)
+	}
+	if nil == result || "done" != result.Value {
+		t.Errorf("Expected the call result, got %v", result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result = nil
+	if err := await(ctx, make(chan *awaitResult), &result); context.Canceled != err {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if nil != result {
+		t.Errorf("Expected no result, got %v", result)
+	}
+}
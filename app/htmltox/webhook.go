@@ -0,0 +1,141 @@
+package htmltox
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Callback delivery statuses
+*/
+const (
+	CallbackPending   = "pending"
+	CallbackDelivered = "delivered"
+	CallbackFailed    = "failed"
+)
+
+/*
+SignatureHeader is the request header containing the HMAC-SHA256 signature of a
+callback body, in the form "sha256=<hex digest>"
+*/
+const SignatureHeader = "X-HTMLToX-Signature"
+
+/*
+Callback describes the webhook notification for a job and its delivery log
+*/
+type Callback struct {
+	URL        string     `json:"url"`
+	Body       string     `json:"body"`
+	Status     string     `json:"status"`
+	Deliveries []Delivery `json:"deliveries"`
+
+	// baseURL is the service address used for the result location
+	baseURL string
+}
+
+/*
+Delivery is a single attempt to deliver a callback
+*/
+type Delivery struct {
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	Status     int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+/*
+Webhook delivers signed callback requests, retrying failures with exponential
+backoff
+*/
+type Webhook struct {
+	secret   []byte
+	attempts int
+	backoff  time.Duration
+	client   *http.Client
+}
+
+/*
+NewWebhook returns a pointer to a Webhook that signs requests with secret and
+makes up to attempts delivery attempts, waiting backoff, then twice as long,
+and so on, between them
+*/
+func NewWebhook(secret string, attempts int, backoff time.Duration) *Webhook {
+	return &Webhook{
+		secret:   []byte(secret),
+		attempts: attempts,
+		backoff:  backoff,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+/*
+Sign returns the signature header value for a callback body
+*/
+func (webhook *Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, webhook.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+Deliver posts the body to the callback URL until it is accepted with a 2xx
+response or the attempts run out. Each attempt is passed to record.
+*/
+func (webhook *Webhook) Deliver(jobID, url, contentType string, body []byte, record func(Delivery)) bool {
+	backoff := webhook.backoff
+	for attempt := 1; attempt <= webhook.attempts; attempt++ {
+		delivery := Delivery{Attempt: attempt, Time: time.Now()}
+		status, err := webhook.post(jobID, url, contentType, body, attempt)
+		delivery.DurationMS = int64(time.Since(delivery.Time) / time.Millisecond)
+		delivery.Status = status
+		if nil == err && (200 > status || 300 <= status) {
+			err = fmt.Errorf("Callback returned '%d %s'", status, http.StatusText(status))
+		}
+		if nil != err {
+			delivery.Error = err.Error()
+		}
+		record(delivery)
+
+		if nil == err {
+			log.Debugf("Job %s callback delivered to '%s'", jobID, url)
+			return true
+		}
+		log.Warnf("Job %s callback attempt %d/%d failed: %s", jobID, attempt, webhook.attempts, err)
+		if attempt < webhook.attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	log.Errorf("Job %s callback to '%s' failed", jobID, url)
+	return false
+}
+
+/*
+post makes a single signed callback request and returns the response code
+*/
+func (webhook *Webhook) post(jobID, url, contentType string, body []byte, attempt int) (int, error) {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if nil != err {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("X-HTMLToX-Job", jobID)
+	request.Header.Set("X-HTMLToX-Attempt", strconv.Itoa(attempt))
+	request.Header.Set(SignatureHeader, webhook.Sign(body))
+
+	response, err := webhook.client.Do(request)
+	if nil != err {
+		return 0, err
+	}
+	response.Body.Close()
+	return response.StatusCode, nil
+}
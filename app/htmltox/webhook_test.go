@@ -0,0 +1,120 @@
+package htmltox
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+TestWebhookSign checks the signature against a published HMAC-SHA256 test
+vector
+*/
+func TestWebhookSign(t *testing.T) {
+	webhook := NewWebhook("key", 1, 0)
+	signature := webhook.Sign([]byte("The quick brown fox jumps over the lazy dog"))
+	expected := "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+	if expected != signature {
+		t.Errorf("Expected signature '%s', got '%s'", expected, signature)
+	}
+}
+
+/*
+TestWebhookDeliver checks that failed deliveries are retried with a doubling
+backoff and that every attempt is signed
+*/
+func TestWebhookDeliver(t *testing.T) {
+	webhook := NewWebhook("secret", 3, 20*time.Millisecond)
+	body := []byte(`{"id":"job"}`)
+
+	mux := sync.Mutex{}
+	times := []time.Time{}
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		mux.Lock()
+		times = append(times, time.Now())
+		attempt := len(times)
+		mux.Unlock()
+
+		received, _ := ioutil.ReadAll(request.Body)
+		if string(body) != string(received) {
+			t.Errorf("Attempt %d: expected body '%s', got '%s'", attempt, body, received)
+		}
+		if webhook.Sign(body) != request.Header.Get(SignatureHeader) {
+			t.Errorf("Attempt %d: invalid signature '%s'", attempt, request.Header.Get(SignatureHeader))
+		}
+		if "job" != request.Header.Get("X-HTMLToX-Job") {
+			t.Errorf("Attempt %d: expected job header 'job', got '%s'", attempt, request.Header.Get("X-HTMLToX-Job"))
+		}
+		if strconv.Itoa(attempt) != request.Header.Get("X-HTMLToX-Attempt") {
+			t.Errorf("Attempt %d: got attempt header '%s'", attempt, request.Header.Get("X-HTMLToX-Attempt"))
+		}
+		if 3 > attempt {
+			response.WriteHeader(500)
+		}
+	}))
+	defer server.Close()
+
+	deliveries := []Delivery{}
+	delivered := webhook.Deliver("job", server.URL, "application/json", body, func(delivery Delivery) {
+		deliveries = append(deliveries, delivery)
+	})
+	if !delivered {
+		t.Fatal("Expected the callback to be delivered")
+	}
+
+	if 3 != len(deliveries) {
+		t.Fatalf("Expected 3 deliveries, got %d", len(deliveries))
+	}
+	for a, status := range []int{500, 500, 200} {
+		if status != deliveries[a].Status {
+			t.Errorf("Delivery %d: expected status %d, got %d", a+1, status, deliveries[a].Status)
+		}
+		if a+1 != deliveries[a].Attempt {
+			t.Errorf("Delivery %d: got attempt %d", a+1, deliveries[a].Attempt)
+		}
+		if (200 == status) != ("" == deliveries[a].Error) {
+			t.Errorf("Delivery %d: unexpected error '%s'", a+1, deliveries[a].Error)
+		}
+	}
+
+	if wait := times[1].Sub(times[0]); 20*time.Millisecond > wait {
+		t.Errorf("Expected a backoff of at least 20ms, got %s", wait)
+	}
+	if wait := times[2].Sub(times[1]); 40*time.Millisecond > wait {
+		t.Errorf("Expected a backoff of at least 40ms, got %s", wait)
+	}
+}
+
+/*
+TestWebhookDeliverFailed checks that delivery stops after the last attempt
+*/
+func TestWebhookDeliverFailed(t *testing.T) {
+	webhook := NewWebhook("secret", 2, time.Millisecond)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requests++
+		response.WriteHeader(404)
+	}))
+	defer server.Close()
+
+	deliveries := []Delivery{}
+	delivered := webhook.Deliver("job", server.URL, "application/json", []byte("{}"), func(delivery Delivery) {
+		deliveries = append(deliveries, delivery)
+	})
+	if delivered {
+		t.Error("Expected the callback delivery to fail")
+	}
+	if 2 != requests || 2 != len(deliveries) {
+		t.Errorf("Expected 2 attempts, got %d requests and %d deliveries", requests, len(deliveries))
+	}
+	for _, delivery := range deliveries {
+		if 404 != delivery.Status || "" == delivery.Error {
+			t.Errorf("Attempt %d: expected a 404 error, got %d '%s'", delivery.Attempt, delivery.Status, delivery.Error)
+		}
+	}
+}
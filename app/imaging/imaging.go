@@ -0,0 +1,188 @@
+/*
+Package imaging post-processes captured images: cropping, resizing and
+grayscale conversion
+*/
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+/*
+ErrEmptyCrop is returned by Process when the crop rectangle does not overlap
+the image
+*/
+var ErrEmptyCrop = errors.New("The crop rectangle is outside of the image")
+
+/*
+Options defines the processing steps. They are applied in field order, so the
+image is cropped before it is resized.
+*/
+type Options struct {
+	// Crop is the rectangle to keep, in image pixels. An empty rectangle
+	// keeps the whole image
+	Crop image.Rectangle
+
+	// Width is the target width in pixels, the height is scaled to keep the
+	// aspect ratio. Images are never enlarged, a width of zero or wider than
+	// the image keeps the width
+	Width int
+
+	// Grayscale converts the image to shades of gray, keeping transparency
+	Grayscale bool
+
+	// Quality is the JPEG encoding quality, 1 - 100
+	Quality int
+}
+
+/*
+Process decodes a PNG or JPEG image, applies the processing steps and encodes
+the result in format, either "png" or "jpeg"
+*/
+func Process(data []byte, format string, options Options) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if nil != err {
+		return nil, fmt.Errorf("Failed to decode image: %s", err)
+	}
+
+	img := toRGBA(src)
+	if !options.Crop.Empty() {
+		crop := options.Crop.Add(img.Bounds().Min).Intersect(img.Bounds())
+		if crop.Empty() {
+			return nil, ErrEmptyCrop
+		}
+		img = img.SubImage(crop).(*image.RGBA)
+	}
+	if options.Width > 0 && options.Width < img.Bounds().Dx() {
+		height := img.Bounds().Dy() * options.Width / img.Bounds().Dx()
+		if height < 1 {
+			height = 1
+		}
+		img = Resize(img, options.Width, height)
+	}
+	if options.Grayscale {
+		Grayscale(img)
+	}
+
+	return Encode(img, format, options.Quality)
+}
+
+/*
+Encode encodes an image in format, either "png" or "jpeg". quality is the JPEG
+encoding quality, 1 - 100, or zero for the default quality. Transparent images
+are encoded as JPEG on a white background.
+*/
+func Encode(img image.Image, format string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		if quality < 1 || quality > 100 {
+			quality = jpeg.DefaultQuality
+		}
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: quality})
+	default:
+		return nil, fmt.Errorf("Images can not be encoded in the '%s' format", format)
+	}
+	if nil != err {
+		return nil, fmt.Errorf("Failed to encode image: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+flatten returns img composited onto a white background. JPEG has no
+transparency, without a background transparent pixels would be encoded black.
+*/
+func flatten(img image.Image) image.Image {
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flat
+}
+
+/*
+toRGBA returns img as an *image.RGBA
+*/
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+/*
+Resize returns a copy of img scaled to width x height pixels. Each pixel is the
+average of the source pixels it covers, which keeps downscaled text and lines
+legible.
+*/
+func Resize(img *image.RGBA, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := (y + 1) * srcHeight / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := (x + 1) * srcWidth / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				offset := img.PixOffset(bounds.Min.X+x0, bounds.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(img.Pix[offset])
+					g += uint64(img.Pix[offset+1])
+					b += uint64(img.Pix[offset+2])
+					a += uint64(img.Pix[offset+3])
+					offset += 4
+					count++
+				}
+			}
+
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8((r + count/2) / count)
+			dst.Pix[offset+1] = uint8((g + count/2) / count)
+			dst.Pix[offset+2] = uint8((b + count/2) / count)
+			dst.Pix[offset+3] = uint8((a + count/2) / count)
+		}
+	}
+
+	return dst
+}
+
+/*
+Grayscale converts img to shades of gray in place, using the ITU-R BT.601 luma
+weights of the color.GrayModel
+*/
+func Grayscale(img *image.RGBA) {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		offset := img.PixOffset(bounds.Min.X, y)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b := uint32(img.Pix[offset]), uint32(img.Pix[offset+1]), uint32(img.Pix[offset+2])
+			luma := uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 16)
+			img.Pix[offset] = luma
+			img.Pix[offset+1] = luma
+			img.Pix[offset+2] = luma
+			offset += 4
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+/*
+testImage returns a PNG encoded 40x20 image, red on the left, transparent on
+the right
+*/
+func testImage(t *testing.T) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			img.Set(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); nil != err {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+/*
+TestProcess checks the size and colors of processed images in both formats
+*/
+func TestProcess(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		options Options
+		size    image.Point
+		left    color.RGBA
+		right   color.RGBA
+	}{
+		{"png round-trip", "png", Options{}, image.Pt(40, 20), color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 0, 0}},
+		{"jpeg on white", "jpeg", Options{Quality: 100}, image.Pt(40, 20), color.RGBA{255, 0, 0, 255}, color.RGBA{255, 255, 255, 255}},
+		{"crop", "png", Options{Crop: image.Rect(10, 5, 30, 15)}, image.Pt(20, 10), color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 0, 0}},
+		{"crop past the edge", "png", Options{Crop: image.Rect(30, 10, 60, 40)}, image.Pt(10, 10), color.RGBA{0, 0, 0, 0}, color.RGBA{0, 0, 0, 0}},
+		{"resize", "png", Options{Width: 20}, image.Pt(20, 10), color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 0, 0}},
+		{"never enlarge", "png", Options{Width: 80}, image.Pt(40, 20), color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 0, 0}},
+		{"grayscale", "png", Options{Grayscale: true}, image.Pt(40, 20), color.RGBA{76, 76, 76, 255}, color.RGBA{0, 0, 0, 0}},
+		{"grayscale jpeg", "jpeg", Options{Grayscale: true, Quality: 100}, image.Pt(40, 20), color.RGBA{76, 76, 76, 255}, color.RGBA{255, 255, 255, 255}},
+	}
+	data := testImage(t)
+	for _, test := range tests {
+		processed, err := Process(data, test.format, test.options)
+		if nil != err {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		img, format, err := image.Decode(bytes.NewReader(processed))
+		if nil != err {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if test.format != format {
+			t.Errorf("%s: expected format %s, got %s", test.name, test.format, format)
+		}
+		bounds := img.Bounds()
+		if test.size != bounds.Size() {
+			t.Errorf("%s: expected size %v, got %v", test.name, test.size, bounds.Size())
+			continue
+		}
+		for _, pixel := range []struct {
+			point    image.Point
+			expected color.RGBA
+		}{
+			{bounds.Min.Add(image.Pt(1, 1)), test.left},
+			{bounds.Max.Sub(image.Pt(2, 2)), test.right},
+		} {
+			if !similar(pixel.expected, img.At(pixel.point.X, pixel.point.Y)) {
+				t.Errorf("%s: expected %v at %v, got %v", test.name, pixel.expected, pixel.point, img.At(pixel.point.X, pixel.point.Y))
+			}
+		}
+	}
+}
+
+/*
+TestProcessErrors checks that crops outside of the image and unknown formats
+are rejected
+*/
+func TestProcessErrors(t *testing.T) {
+	data := testImage(t)
+	if _, err := Process(data, "png", Options{Crop: image.Rect(50, 0, 60, 10)}); ErrEmptyCrop != err {
+		t.Errorf("Expected ErrEmptyCrop for a crop outside of the image, got %v", err)
+	}
+	if _, err := Process(data, "gif", Options{}); nil == err {
+		t.Error("Expected an error for the 'gif' format")
+	}
+	if _, err := Process([]byte("not an image"), "png", Options{}); nil == err {
+		t.Error("Expected an error for invalid image data")
+	}
+}
+
+/*
+similar returns true if the colors differ by no more than JPEG compression
+would change them
+*/
+func similar(expected color.RGBA, actual color.Color) bool {
+	r, g, b, a := actual.RGBA()
+	for _, channel := range [][2]uint32{
+		{uint32(expected.R), r >> 8},
+		{uint32(expected.G), g >> 8},
+		{uint32(expected.B), b >> 8},
+		{uint32(expected.A), a >> 8},
+	} {
+		if channel[0] > channel[1]+4 || channel[1] > channel[0]+4 {
+			return false
+		}
+	}
+	return true
+}
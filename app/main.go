@@ -4,6 +4,10 @@ Package main executes the HTML Conversion Service
 package main
 
 import (
+	"flag"
+	"os"
+
+	"github.com/mkenney/docker-htmltox/app/config"
 	htmltox "github.com/mkenney/docker-htmltox/app/htmltox"
 	log "github.com/sirupsen/logrus"
 )
@@ -13,10 +17,18 @@ func init() {
 }
 
 func main() {
-	htmltox, err := htmltox.New()
+	path := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*path)
+	if nil != err {
+		log.Fatalf("Invalid configuration: %s", err.Error())
+	}
+
+	htmltox, err := htmltox.New(cfg)
 	if nil != err {
 		log.Fatalf("Could not initialize conversion service: %s", err.Error())
 	}
-	log.Info("Starting API server")
-	htmltox.API.Run(80)
+	log.Infof("Starting API server on %s", cfg.Listen)
+	htmltox.API.Run(cfg.Listen)
 }
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+Local stores objects as files in a directory
+*/
+type Local struct {
+	dir string
+}
+
+/*
+NewLocal returns a pointer to a Local backend that stores files in dir,
+creating it if necessary
+*/
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0755); nil != err {
+		return nil, fmt.Errorf("Failed to create storage directory: %s", err)
+	}
+	return &Local{dir: dir}, nil
+}
+
+/*
+Put writes data to the file for key. The file is written atomically so readers
+never see a partial object.
+*/
+func (local *Local) Put(key, contentType string, data []byte) error {
+	path, err := local.path(key)
+	if nil != err {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); nil != err {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if nil != err {
+		return err
+	}
+	if _, err := tmp.Write(data); nil != err {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); nil != err {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+/*
+Get reads the file for key. The content type is derived from the extension.
+*/
+func (local *Local) Get(key string) ([]byte, string, error) {
+	path, err := local.path(key)
+	if nil != err {
+		return nil, "", err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, "", ErrNotFound
+	} else if nil != err {
+		return nil, "", err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if "" == contentType {
+		contentType = "application/octet-stream"
+	}
+	return data, contentType, nil
+}
+
+/*
+URL returns an empty string, local files are not downloadable
+*/
+func (local *Local) URL(key string, ttl time.Duration) (string, error) {
+	return "", nil
+}
+
+/*
+path returns the file path for a key, rejecting keys outside the directory
+*/
+func (local *Local) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if "/" == clean || strings.Contains(key, "..") {
+		return "", fmt.Errorf("Invalid key '%s'", key)
+	}
+	return filepath.Join(local.dir, clean), nil
+}
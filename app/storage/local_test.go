@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+/*
+TestLocal checks that stored files are read back and that keys can't escape
+the storage directory
+*/
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htmltox-storage-")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local, err := NewLocal(dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if err := local.Put("renders/page.png", "image/png", []byte("data")); nil != err {
+		t.Fatal(err)
+	}
+	data, contentType, err := local.Get("renders/page.png")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "data" != string(data) || "image/png" != contentType {
+		t.Errorf("Expected 'data' as 'image/png', got '%s' as '%s'", data, contentType)
+	}
+
+	if _, _, err := local.Get("renders/missing.png"); ErrNotFound != err {
+		t.Errorf("Expected ErrNotFound for a missing file, got %v", err)
+	}
+	for _, key := range []string{"", "/", "../page.png", "renders/../../page.png"} {
+		if err := local.Put(key, "image/png", []byte("data")); nil == err {
+			t.Errorf("Expected an error for key '%s'", key)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+S3 stores objects in an S3-compatible bucket such as AWS S3 or MinIO
+
+Requests are signed with AWS Signature Version 4 and use path-style URLs, e.g.
+"https://endpoint/bucket/key", which every S3-compatible service supports.
+*/
+type S3 struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+/*
+NewS3 returns a pointer to an S3 backend for a bucket
+*/
+func NewS3(endpoint, region, bucket, accessKey, secretKey string) (*S3, error) {
+	parsed, err := url.Parse(endpoint)
+	if nil != err || "" == parsed.Host || ("http" != parsed.Scheme && "https" != parsed.Scheme) {
+		return nil, fmt.Errorf("Invalid S3 endpoint '%s'", endpoint)
+	} else if "" == bucket {
+		return nil, fmt.Errorf("An S3 bucket is required")
+	} else if "" == accessKey || "" == secretKey {
+		return nil, fmt.Errorf("S3 credentials are required")
+	}
+	if "" == region {
+		region = "us-east-1"
+	}
+	return &S3{
+		endpoint:  parsed,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+/*
+Put uploads data to the bucket
+*/
+func (s3 *S3) Put(key, contentType string, data []byte) error {
+	request, err := http.NewRequest("PUT", s3.objectURL(key).String(), bytes.NewReader(data))
+	if nil != err {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	s3.sign(request, data, time.Now())
+
+	response, err := s3.client.Do(request)
+	if nil != err {
+		return err
+	}
+	defer response.Body.Close()
+	if 200 != response.StatusCode {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("S3 PUT '%s' failed: %s %s", key, response.Status, body)
+	}
+	return nil
+}
+
+/*
+Get downloads an object from the bucket
+*/
+func (s3 *S3) Get(key string) ([]byte, string, error) {
+	request, err := http.NewRequest("GET", s3.objectURL(key).String(), nil)
+	if nil != err {
+		return nil, "", err
+	}
+	s3.sign(request, []byte{}, time.Now())
+
+	response, err := s3.client.Do(request)
+	if nil != err {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if 404 == response.StatusCode {
+		return nil, "", ErrNotFound
+	} else if 200 != response.StatusCode {
+		return nil, "", fmt.Errorf("S3 GET '%s' failed: %s %s", key, response.Status, body)
+	} else if nil != err {
+		return nil, "", err
+	}
+	return body, response.Header.Get("Content-Type"), nil
+}
+
+/*
+maxURLTTL is the longest period a pre-signed URL can be valid for
+*/
+const maxURLTTL = 7 * 24 * time.Hour
+
+/*
+URL returns a pre-signed download URL that is valid for the ttl period, at most
+seven days
+*/
+func (s3 *S3) URL(key string, ttl time.Duration) (string, error) {
+	now := time.Now().UTC()
+	if ttl > maxURLTTL {
+		ttl = maxURLTTL
+	}
+	objectURL := s3.objectURL(key)
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s3.accessKey+"/"+s3.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		objectURL.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + objectURL.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	query.Set("X-Amz-Signature", s3.signature(now, canonicalRequest))
+	objectURL.RawQuery = canonicalQuery(query)
+	return objectURL.String(), nil
+}
+
+/*
+objectURL returns the path-style URL of an object
+*/
+func (s3 *S3) objectURL(key string) *url.URL {
+	objectURL := *s3.endpoint
+	segments := []string{s3.bucket}
+	segments = append(segments, strings.Split(key, "/")...)
+	escaped := make([]string, len(segments))
+	for a, segment := range segments {
+		escaped[a] = uriEncode(segment)
+	}
+	objectURL.Path = strings.TrimRight(s3.endpoint.Path, "/") + "/" + strings.Join(segments, "/")
+	objectURL.RawPath = strings.TrimRight(s3.endpoint.EscapedPath(), "/") + "/" + strings.Join(escaped, "/")
+	return &objectURL
+}
+
+/*
+sign adds the Signature Version 4 authorization headers to a request
+*/
+func (s3 *S3) sign(request *http.Request, payload []byte, now time.Time) {
+	now = now.UTC()
+	payloadHash := sha256Hex(payload)
+	request.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + request.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + now.Format("20060102T150405Z") + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.accessKey,
+		s3.scope(now),
+		signedHeaders,
+		s3.signature(now, canonicalRequest),
+	))
+}
+
+/*
+scope returns the credential scope for a request date
+*/
+func (s3 *S3) scope(now time.Time) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), s3.region)
+}
+
+/*
+signature returns the Signature Version 4 signature of a canonical request
+*/
+func (s3 *S3) signature(now time.Time, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		s3.scope(now),
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s3.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s3.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+/*
+canonicalQuery returns the query string sorted by key with values encoded as
+Signature Version 4 requires
+*/
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+/*
+uriEncode percent-encodes everything except the RFC 3986 unreserved characters
+*/
+func uriEncode(value string) string {
+	encoded := &strings.Builder{}
+	for _, char := range []byte(value) {
+		if ('A' <= char && char <= 'Z') || ('a' <= char && char <= 'z') || ('0' <= char && char <= '9') ||
+			'-' == char || '_' == char || '.' == char || '~' == char {
+			encoded.WriteByte(char)
+		} else {
+			fmt.Fprintf(encoded, "%%%02X", char)
+		}
+	}
+	return encoded.String()
+}
+
+/*
+sha256Hex returns the hex encoded SHA-256 hash of data
+*/
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+hmacSHA256 returns the HMAC-SHA256 of data signed with key
+*/
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
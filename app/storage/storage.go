@@ -0,0 +1,94 @@
+/*
+Package storage defines the backends that rendered output can be written to
+*/
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+ErrNotFound is returned by Get when no object is stored under a key
+*/
+var ErrNotFound = errors.New("Object not found")
+
+/*
+Storage defines an object storage backend
+*/
+type Storage interface {
+	// Put stores data under key
+	Put(key, contentType string, data []byte) error
+
+	// Get returns the data and content type stored under key
+	Get(key string) ([]byte, string, error)
+
+	// URL returns a URL the object can be downloaded from for the ttl
+	// period, or an empty string if the backend can't provide one
+	URL(key string, ttl time.Duration) (string, error)
+}
+
+/*
+Object describes a stored object
+*/
+type Object struct {
+	Key         string `json:"key"`
+	URL         string `json:"url,omitempty"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+/*
+extensions maps content types to file extensions for generated keys
+*/
+var extensions = map[string]string{
+	"application/json": "json",
+	"application/pdf":  "pdf",
+	"application/zip":  "zip",
+	"image/jpeg":       "jpg",
+	"image/png":        "png",
+	"image/webp":       "webp",
+}
+
+/*
+Store writes data to the backend under a generated key and returns the object,
+with a download URL valid for the ttl period if the backend provides one
+*/
+func Store(backend Storage, contentType string, data []byte, ttl time.Duration) (*Object, error) {
+	key, err := NewKey(contentType)
+	if nil != err {
+		return nil, err
+	}
+	if err := backend.Put(key, contentType, data); nil != err {
+		return nil, err
+	}
+
+	url, err := backend.URL(key, ttl)
+	if nil != err {
+		return nil, err
+	}
+	return &Object{
+		Key:         key,
+		URL:         url,
+		ContentType: contentType,
+		Size:        len(data),
+	}, nil
+}
+
+/*
+NewKey returns a unique object key in the form "YYYY/MM/DD/<id>.<extension>"
+*/
+func NewKey(contentType string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); nil != err {
+		return "", err
+	}
+	key := fmt.Sprintf("%s/%s", time.Now().UTC().Format("2006/01/02"), hex.EncodeToString(id))
+	if extension, ok := extensions[contentType]; ok {
+		key += "." + extension
+	}
+	return key, nil
+}